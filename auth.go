@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"log"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -36,6 +40,17 @@ func checkDownloadToken(ctx context.Context, downloadToken string) (bool, error)
 	return true, nil
 }
 
+/* admin endpoints take "Authorization: Bearer <ADMIN_TOKEN>"; with
+   no ADMIN_TOKEN set they refuse everyone */
+func checkAdminToken(req *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	auth := req.Header.Get("Authorization")
+	if token == "" || len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(token)) == 1
+}
+
 /*
 func checkDeviceAndSession(ctx context.Context, downloadToken string) (string, bool, error) {
 	return "", false, nil
@@ -1,66 +1,322 @@
 package main
 
 import (
-	"io"
+	"context"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"time"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 var sess = session.New()
-var s3svc = s3.New(sess)
-var s3downloader = s3manager.NewDownloaderWithClient(s3svc)
-var s3uploader = s3manager.NewUploader(sess)
+
+/* clients for one region; tenants in the same region share them */
+type awsRegionClients struct {
+	region     string
+	svc        *s3.S3
+	downloader *s3manager.Downloader
+	uploader   *s3manager.Uploader
+	kms        *kms.KMS
+}
+
+var (
+	regionClientsMu sync.Mutex
+	regionClients = map[string]*awsRegionClients{}
+)
+
+/* "" is the region the session is configured with */
+func awsClientsFor(region string) *awsRegionClients {
+	regionClientsMu.Lock()
+	defer regionClientsMu.Unlock()
+	if clients, ok := regionClients[region]; ok {
+		return clients
+	}
+	var svc *s3.S3
+	var kmssvc *kms.KMS
+	if region == "" {
+		svc = s3.New(sess)
+		kmssvc = kms.New(sess)
+		region = aws.StringValue(sess.Config.Region)
+	} else {
+		svc = s3.New(sess, aws.NewConfig().WithRegion(region))
+		kmssvc = kms.New(sess, aws.NewConfig().WithRegion(region))
+	}
+	clients := &awsRegionClients{
+		region: region,
+		svc: svc,
+		downloader: s3manager.NewDownloaderWithClient(svc),
+		uploader: s3manager.NewUploaderWithClient(svc),
+		kms: kmssvc,
+	}
+	regionClients[region] = clients
+	return clients
+}
+
+/* Keys passed to and returned by these functions are the tenant's
+   own; the tenant's prefix is added and removed here. */
 
 type awsKeyFunc func (key string) bool
 
-func awsList(bucket string, prefix string, startAfter string, onKey awsKeyFunc) error {
-	return s3svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
-		StartAfter: aws.String(startAfter),
-	}, func (page *s3.ListObjectsV2Output, lastPage bool) bool {
+/* info has no metadata, listings don't return it */
+type awsObjectFunc func (key string, info *awsObjectInfo) bool
+
+func awsList(ctx context.Context, tn *tenant, prefix string, startAfter string, onKey awsKeyFunc) error {
+	return awsListObjects(ctx, tn, prefix, startAfter, func (key string, info *awsObjectInfo) bool {
+		return onKey(key)
+	})
+}
+
+/* each page is fetched, and retried, on its own, starting after
+   the last key handed to onObject, so no key is seen twice and the
+   time onObject takes doesn't count against listRetry's deadline */
+func awsListObjects(ctx context.Context, tn *tenant, prefix string, startAfter string, onObject awsObjectFunc) error {
+	for {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(tn.Bucket),
+			Prefix: aws.String(tn.key(prefix)),
+		}
+		if startAfter != "" {
+			input.StartAfter = aws.String(tn.key(startAfter))
+		}
+		var page *s3.ListObjectsV2Output
+		err := listRetry.do(ctx, tn.Name + ":" + prefix, func (ctx context.Context) error {
+			var err error
+			page, err = tn.clients().svc.ListObjectsV2WithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return err
+		}
 		for _, item := range page.Contents {
-			if !onKey(*item.Key) {
-				return false
+			key := strings.TrimPrefix(*item.Key, tn.Prefix)
+			startAfter = key
+			info := &awsObjectInfo{
+				size: aws.Int64Value(item.Size),
+				etag: strings.Trim(aws.StringValue(item.ETag), `"`),
+				lastModified: aws.TimeValue(item.LastModified),
+			}
+			if !onObject(key, info) {
+				return nil
 			}
 		}
-		return true
-	})
+		if !aws.BoolValue(page.IsTruncated) || len(page.Contents) == 0 {
+			return nil
+		}
+	}
 }
 
-func awsDownload(bucket string, key string) ([]byte, int64, error) {
-	buff := &aws.WriteAtBuffer{}
-	numBytes, err := s3downloader.Download(buff,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		})
+func awsDownload(ctx context.Context, tn *tenant, key string) ([]byte, int64, error) {
+	var buff *aws.WriteAtBuffer
+	var numBytes int64
+	err := objectDownloadRetry.do(ctx, tn.Name + ":" + key, func (ctx context.Context) error {
+		var err error
+		buff = &aws.WriteAtBuffer{}
+		numBytes, err = tn.clients().downloader.DownloadWithContext(ctx, buff,
+			&s3.GetObjectInput{
+				Bucket: aws.String(tn.Bucket),
+				Key:    aws.String(tn.key(key)),
+			})
+		return err
+	})
 	if err != nil {
 		return nil, 0, err
 	}
 	return buff.Bytes(), numBytes, nil
 }
 
-func awsUpload(bucket string, key string, r io.Reader) (string, error) {
-	result, err := s3uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucket),
-		Key: aws.String(key),
+/* what is stored along with an object we write; opts may be nil */
+type awsObjectOptions struct {
+	contentType string
+	metadata    map[string]string
+}
+
+/* bodies that can't be rewound only get one try */
+func awsUpload(ctx context.Context, tn *tenant, key string, r io.Reader, opts *awsObjectOptions) (string, error) {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(tn.Bucket),
+		Key: aws.String(tn.key(key)),
 		Body: r,
+	}
+	if opts != nil {
+		if opts.contentType != "" {
+			input.ContentType = aws.String(opts.contentType)
+		}
+		if len(opts.metadata) > 0 {
+			input.Metadata = aws.StringMap(opts.metadata)
+		}
+	}
+	if sse, keyId := tn.sse(); sse != "" {
+		input.ServerSideEncryption = aws.String(sse)
+		if keyId != "" {
+			input.SSEKMSKeyId = aws.String(keyId)
+		}
+	}
+	var location string
+	attempt := 0
+	err := objectUploadRetry.do(ctx, tn.Name + ":" + key, func (ctx context.Context) error {
+		seeker, canRewind := r.(io.Seeker)
+		if attempt > 0 {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return &permanentError{ err }
+			}
+		}
+		attempt++
+		result, err := tn.clients().uploader.UploadWithContext(ctx, input)
+		if err != nil && !canRewind {
+			return &permanentError{ err }
+		} else if err != nil {
+			return err
+		}
+		location = result.Location
+		return nil
 	})
 	if err != nil {
 		return "", err
 	}
-	return result.Location, nil
+	return location, nil
 }
 
-func awsMakeSignedUrl(bucket string, key string) (string, error) {
-	req, _ := s3svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
-	if req == nil {
-		return "", fmt.Errorf("could not prepare request for signing %s:%s", bucket, key)
+func awsCreateMultipartUpload(ctx context.Context, tn *tenant, key string, opts *awsObjectOptions) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(tn.Bucket),
+		Key: aws.String(tn.key(key)),
 	}
-	return req.Presign(24 * time.Hour)
+	if opts != nil {
+		if opts.contentType != "" {
+			input.ContentType = aws.String(opts.contentType)
+		}
+		if len(opts.metadata) > 0 {
+			input.Metadata = aws.StringMap(opts.metadata)
+		}
+	}
+	/* parts inherit it, so their presigned URLs need nothing */
+	if sse, keyId := tn.sse(); sse != "" {
+		input.ServerSideEncryption = aws.String(sse)
+		if keyId != "" {
+			input.SSEKMSKeyId = aws.String(keyId)
+		}
+	}
+	var uploadId string
+	err := uploadRetry.do(ctx, tn.Name + ":" + key, func (ctx context.Context) error {
+		result, err := tn.clients().svc.CreateMultipartUploadWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		uploadId = aws.StringValue(result.UploadId)
+		return nil
+	})
+	return uploadId, err
+}
+
+type awsCompletedPart struct {
+	PartNumber int64  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+func awsCompleteMultipartUpload(ctx context.Context, tn *tenant, key string, uploadId string, parts []awsCompletedPart) (string, error) {
+	completed := &s3.CompletedMultipartUpload{}
+	for _, part := range parts {
+		completed.Parts = append(completed.Parts, &s3.CompletedPart{
+			PartNumber: aws.Int64(part.PartNumber),
+			ETag: aws.String(part.ETag),
+		})
+	}
+	var location string
+	err := uploadRetry.do(ctx, tn.Name + ":" + key, func (ctx context.Context) error {
+		result, err := tn.clients().svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket: aws.String(tn.Bucket),
+			Key: aws.String(tn.key(key)),
+			UploadId: aws.String(uploadId),
+			MultipartUpload: completed,
+		})
+		if err != nil {
+			return err
+		}
+		location = aws.StringValue(result.Location)
+		return nil
+	})
+	return location, err
+}
+
+func awsAbortMultipartUpload(ctx context.Context, tn *tenant, key string, uploadId string) error {
+	return uploadRetry.do(ctx, tn.Name + ":" + key, func (ctx context.Context) error {
+		_, err := tn.clients().svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket: aws.String(tn.Bucket),
+			Key: aws.String(tn.key(key)),
+			UploadId: aws.String(uploadId),
+		})
+		return err
+	})
+}
+
+type awsObjectInfo struct {
+	size         int64
+	etag         string
+	lastModified time.Time
+	metadata     map[string]string
+}
+
+/* metadata keys come back canonicalized, e.g. "Quarantine" for
+   x-amz-meta-quarantine; they are lowercased here */
+func awsHead(ctx context.Context, tn *tenant, key string) (*awsObjectInfo, error) {
+	var info *awsObjectInfo
+	err := downloadRetry.do(ctx, tn.Name + ":" + key, func (ctx context.Context) error {
+		result, err := tn.clients().svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(tn.Bucket),
+			Key: aws.String(tn.key(key)),
+		})
+		if err != nil {
+			return err
+		}
+		info = &awsObjectInfo{
+			size: aws.Int64Value(result.ContentLength),
+			etag: strings.Trim(aws.StringValue(result.ETag), `"`),
+			lastModified: aws.TimeValue(result.LastModified),
+			metadata: map[string]string{},
+		}
+		for name, value := range result.Metadata {
+			info.metadata[strings.ToLower(name)] = aws.StringValue(value)
+		}
+		return nil
+	})
+	return info, err
+}
+
+/* S3 takes at most this many keys per DeleteObjects */
+const MaxDeleteBatch = 1000
+
+/* deletes up to MaxDeleteBatch keys; the keys S3 refused come
+   back with its reason. Deleting a key that is already gone
+   succeeds, so the whole batch can be retried. */
+func awsDeleteObjects(ctx context.Context, tn *tenant, keys []string) (map[string]string, error) {
+	if len(keys) > MaxDeleteBatch {
+		return nil, fmt.Errorf("cannot delete %d keys at once", len(keys))
+	}
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = &s3.ObjectIdentifier{ Key: aws.String(tn.key(key)) }
+	}
+	var failed map[string]string
+	err := deleteRetry.do(ctx, fmt.Sprintf("%s:%d keys", tn.Name, len(keys)), func (ctx context.Context) error {
+		result, err := tn.clients().svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(tn.Bucket),
+			Delete: &s3.Delete{ Objects: objects, Quiet: aws.Bool(true) },
+		})
+		if err != nil {
+			return err
+		}
+		failed = map[string]string{}
+		for _, e := range result.Errors {
+			key := strings.TrimPrefix(aws.StringValue(e.Key), tn.Prefix)
+			failed[key] = aws.StringValue(e.Code) + ": " + aws.StringValue(e.Message)
+		}
+		return nil
+	})
+	return failed, err
 }
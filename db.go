@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"github.com/go-sql-driver/mysql"
+	"strconv"
+	"strings"
 	"time"
 	"fmt"
 )
@@ -27,22 +29,41 @@ func dbClose() {
 }
 
 type meetingInstanceInfo struct {
-	startedAt time.Time
-	endedAt   time.Time
+	startedAt  time.Time
+	endedAt    time.Time
+	inProgress bool
 }
 
+/* the meeting_instances states of a meeting that is still running */
+var meetingRunningStates = map[string]bool{
+	"Started": true,
+	"InProgress": true,
+}
+
+/* running instances come back with inProgress set and a zero
+   endedAt; callers decide what "now" means for them. Any other
+   instance without ended_at (cancelled, failed, abandoned) has no
+   range and is an error. */
 func dbGetMeetingInstanceInfo(ctx context.Context, id int64) (*meetingInstanceInfo, error) {
 	var startedAt mysql.NullTime
 	var endedAt mysql.NullTime
-	err := DB.QueryRowContext(ctx, "SELECT started_at, ended_at FROM meeting_instances WHERE id=? and state='Ended'", id).Scan(&startedAt, &endedAt)
+	var state sql.NullString
+	err := dbRetry.do(ctx, "meeting instance", func (ctx context.Context) error {
+		return DB.QueryRowContext(ctx, "SELECT started_at, ended_at, state FROM meeting_instances WHERE id=?", id).Scan(&startedAt, &endedAt, &state)
+	})
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	} else if !startedAt.Valid {
 		return nil, fmt.Errorf("null started_at for %d", id)
+	} else if !endedAt.Valid && !meetingRunningStates[state.String] {
+		return nil, fmt.Errorf("null ended_at for %d in state %q", id, state.String)
 	} else if !endedAt.Valid {
-		return nil, fmt.Errorf("null ended_at for %d", id)
+		return &meetingInstanceInfo{
+			startedAt: startedAt.Time,
+			inProgress: true,
+		}, nil
 	} else {
 		return &meetingInstanceInfo{
 			startedAt: startedAt.Time,
@@ -53,7 +74,9 @@ func dbGetMeetingInstanceInfo(ctx context.Context, id int64) (*meetingInstanceIn
 
 func dbDeviceExists(ctx context.Context, deviceId string) (bool, error) {
 	var one int
-	err := DB.QueryRowContext(ctx, "SELECT 1 FROM device WHERE id=?", deviceId).Scan(&one)
+	err := dbRetry.do(ctx, "device", func (ctx context.Context) error {
+		return DB.QueryRowContext(ctx, "SELECT 1 FROM device WHERE id=?", deviceId).Scan(&one)
+	})
 	if err == sql.ErrNoRows {
 		return false, nil
 	} else if err != nil {
@@ -64,7 +87,9 @@ func dbDeviceExists(ctx context.Context, deviceId string) (bool, error) {
 
 func dbQueryForTime(ctx context.Context, query string, args ...interface{}) (*time.Time, error) {
 	var t mysql.NullTime
-	err := DB.QueryRowContext(ctx, query, args...).Scan(&t)
+	err := dbRetry.do(ctx, "time", func (ctx context.Context) error {
+		return DB.QueryRowContext(ctx, query, args...).Scan(&t)
+	})
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -83,3 +108,623 @@ func dbDownloadTokenCreatedAt(ctx context.Context, downloadToken string) (*time.
 func dbMeetingInstanceStartedAt(ctx context.Context, id int64) (*time.Time, error) {
 	return dbQueryForTime(ctx, "SELECT started_at FROM meeting_instances WHERE id=?", id)
 }
+
+func dbGetMeetingInstanceDevices(ctx context.Context, id int64) ([]string, error) {
+	var devices []string
+	err := dbRetry.do(ctx, "meeting devices", func (ctx context.Context) error {
+		devices = nil
+		rows, err := DB.QueryContext(ctx, "SELECT DISTINCT device_id FROM meeting_participants WHERE meeting_instance_id=? AND device_id IS NOT NULL", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var deviceId string
+			if err := rows.Scan(&deviceId); err != nil {
+				return err
+			}
+			devices = append(devices, deviceId)
+		}
+		return rows.Err()
+	})
+	return devices, err
+}
+
+type exportJob struct {
+	id        int64
+	state     string
+	params    string
+	s3Key     string
+	message   string
+	archives  int
+	skipped   string
+	createdAt time.Time
+	expiresAt *time.Time
+	ticketHash string
+	devices   *string
+}
+
+func dbCreateExportJob(ctx context.Context, params string, ticketHash string) (int64, error) {
+	var id int64
+	err := dbRetry.do(ctx, "create export job", func (ctx context.Context) error {
+		result, err := DB.ExecContext(ctx, "INSERT INTO log_export_jobs (state, params, ticket_hash, created_at, updated_at) VALUES ('Queued', ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())", params, ticketHash)
+		if err != nil {
+			return err
+		}
+		id, err = result.LastInsertId()
+		return err
+	})
+	return id, err
+}
+
+func dbGetExportJob(ctx context.Context, id int64) (*exportJob, error) {
+	job := &exportJob{ id: id }
+	var s3Key, message, skipped, ticketHash sql.NullString
+	var createdAt, expiresAt mysql.NullTime
+	err := dbRetry.do(ctx, "export job", func (ctx context.Context) error {
+		return DB.QueryRowContext(ctx, "SELECT state, params, s3_key, message, archives, skipped, created_at, expires_at, ticket_hash FROM log_export_jobs WHERE id=?", id).Scan(
+			&job.state, &job.params, &s3Key, &message, &job.archives, &skipped, &createdAt, &expiresAt, &ticketHash)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	job.s3Key = s3Key.String
+	job.message = message.String
+	job.skipped = skipped.String
+	job.ticketHash = ticketHash.String
+	job.createdAt = createdAt.Time
+	if expiresAt.Valid {
+		job.expiresAt = &expiresAt.Time
+	}
+	return job, nil
+}
+
+/* takes the oldest queued job, or returns nil if there is none.
+   The conditional update makes sure only one worker gets it. */
+func dbClaimExportJob(ctx context.Context) (*exportJob, error) {
+	for {
+		var id int64
+		err := dbRetry.do(ctx, "queued export job", func (ctx context.Context) error {
+			return DB.QueryRowContext(ctx, "SELECT id FROM log_export_jobs WHERE state='Queued' ORDER BY id LIMIT 1").Scan(&id)
+		})
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var claimed int64
+		err = dbRetry.do(ctx, "claim export job", func (ctx context.Context) error {
+			result, err := DB.ExecContext(ctx, "UPDATE log_export_jobs SET state='Running', updated_at=UTC_TIMESTAMP() WHERE id=? AND state='Queued'", id)
+			if err != nil {
+				return err
+			}
+			claimed, err = result.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if claimed == 1 {
+			return dbGetExportJob(ctx, id)
+		}
+	}
+}
+
+func dbFinishExportJob(ctx context.Context, job *exportJob) error {
+	return dbRetry.do(ctx, "finish export job", func (ctx context.Context) error {
+		_, err := DB.ExecContext(ctx, "UPDATE log_export_jobs SET state=?, s3_key=?, message=?, archives=?, skipped=?, expires_at=?, devices=?, updated_at=UTC_TIMESTAMP() WHERE id=?",
+			job.state, job.s3Key, job.message, job.archives, job.skipped, job.expiresAt, job.devices, job.id)
+		return err
+	})
+}
+
+func dbExpireExportJobs(ctx context.Context) (int64, error) {
+	var expired int64
+	err := dbRetry.do(ctx, "expire export jobs", func (ctx context.Context) error {
+		result, err := DB.ExecContext(ctx, "UPDATE log_export_jobs SET state='Expired', updated_at=UTC_TIMESTAMP() WHERE state='Done' AND expires_at < UTC_TIMESTAMP()")
+		if err != nil {
+			return err
+		}
+		expired, err = result.RowsAffected()
+		return err
+	})
+	return expired, err
+}
+
+/* expired jobs whose zip is still in the bucket, up to limit */
+func dbExpiredExportObjects(ctx context.Context, limit int) ([]exportJob, error) {
+	var jobs []exportJob
+	err := dbRetry.do(ctx, "expired exports", func (ctx context.Context) error {
+		jobs = nil
+		rows, err := DB.QueryContext(ctx, "SELECT id, params, s3_key FROM log_export_jobs WHERE state='Expired' AND s3_key IS NOT NULL AND s3_key != '' ORDER BY id LIMIT ?", limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var job exportJob
+			if err := rows.Scan(&job.id, &job.params, &job.s3Key); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+		return rows.Err()
+	})
+	return jobs, err
+}
+
+/* jobs whose zip is still in the bucket, whatever their state */
+func dbStoredExportJobs(ctx context.Context) ([]exportJob, error) {
+	var jobs []exportJob
+	err := dbRetry.do(ctx, "stored exports", func (ctx context.Context) error {
+		jobs = nil
+		rows, err := DB.QueryContext(ctx, "SELECT id, params, s3_key, devices FROM log_export_jobs WHERE s3_key IS NOT NULL AND s3_key != '' ORDER BY id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var job exportJob
+			var devices sql.NullString
+			if err := rows.Scan(&job.id, &job.params, &job.s3Key, &devices); err != nil {
+				return err
+			}
+			if devices.Valid {
+				job.devices = &devices.String
+			}
+			jobs = append(jobs, job)
+		}
+		return rows.Err()
+	})
+	return jobs, err
+}
+
+/* the job reads as expired from then on */
+func dbEraseExportObject(ctx context.Context, id int64) error {
+	return dbRetry.do(ctx, "erase export object", func (ctx context.Context) error {
+		_, err := DB.ExecContext(ctx, "UPDATE log_export_jobs SET state='Expired', s3_key=NULL, message='erased', updated_at=UTC_TIMESTAMP() WHERE id=?", id)
+		return err
+	})
+}
+
+func dbClearExportObject(ctx context.Context, id int64) error {
+	return dbRetry.do(ctx, "clear export object", func (ctx context.Context) error {
+		_, err := DB.ExecContext(ctx, "UPDATE log_export_jobs SET s3_key=NULL, updated_at=UTC_TIMESTAMP() WHERE id=?", id)
+		return err
+	})
+}
+
+/* jobs left Running by a server that went away */
+func dbRequeueStaleExportJobs(ctx context.Context, staleAfter time.Duration) (int64, error) {
+	var requeued int64
+	err := dbRetry.do(ctx, "requeue export jobs", func (ctx context.Context) error {
+		result, err := DB.ExecContext(ctx, "UPDATE log_export_jobs SET state='Queued', updated_at=UTC_TIMESTAMP() WHERE state='Running' AND updated_at < ?", time.Now().UTC().Add(-staleAfter))
+		if err != nil {
+			return err
+		}
+		requeued, err = result.RowsAffected()
+		return err
+	})
+	return requeued, err
+}
+
+/* S3 delivers events at least once, so recording the same
+   upload again just refreshes it; source stays whatever saw the
+   upload first */
+func dbRecordUpload(ctx context.Context, upload *uploadRecord) error {
+	var device sql.NullString
+	if upload.device != "" {
+		device = sql.NullString{ String: upload.device, Valid: true }
+	}
+	var instance sql.NullInt64
+	if upload.meetingInstance != 0 {
+		instance = sql.NullInt64{ Int64: upload.meetingInstance, Valid: true }
+	}
+	var startedAt *time.Time
+	if !upload.startedAt.IsZero() {
+		t := upload.startedAt.UTC()
+		startedAt = &t
+	}
+	return dbRetry.do(ctx, "record upload", func (ctx context.Context) error {
+		_, err := DB.ExecContext(ctx, "INSERT INTO uploads (bucket, s3_key, device_id, size, etag, meeting_instance_id, started_at, uploaded_at, source, recorded_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP()) " +
+			"ON DUPLICATE KEY UPDATE device_id=VALUES(device_id), size=VALUES(size), etag=VALUES(etag), meeting_instance_id=VALUES(meeting_instance_id), started_at=VALUES(started_at), uploaded_at=VALUES(uploaded_at), recorded_at=UTC_TIMESTAMP()",
+			upload.tenant.Bucket, upload.tenant.key(upload.key), device, upload.size, upload.etag, instance, startedAt, upload.uploadedAt.UTC(), upload.source)
+		return err
+	})
+}
+
+/* nil if the tenant has never been fully backfilled */
+func dbUploadIndexWatermark(ctx context.Context, tn *tenant) (*time.Time, error) {
+	var watermark mysql.NullTime
+	err := dbRetry.do(ctx, "upload index watermark", func (ctx context.Context) error {
+		return DB.QueryRowContext(ctx, "SELECT backfilled_at FROM upload_index_watermarks WHERE bucket=? AND prefix=?", tn.Bucket, tn.Prefix).Scan(&watermark)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !watermark.Valid {
+		return nil, nil
+	}
+	return &watermark.Time, nil
+}
+
+/* keeps the earliest, a later backfill proves nothing more */
+func dbSetUploadIndexWatermark(ctx context.Context, tn *tenant, backfilledAt time.Time) error {
+	return dbRetry.do(ctx, "set upload index watermark", func (ctx context.Context) error {
+		_, err := DB.ExecContext(ctx, "INSERT INTO upload_index_watermarks (bucket, prefix, backfilled_at) VALUES (?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE backfilled_at=LEAST(backfilled_at, VALUES(backfilled_at))",
+			tn.Bucket, tn.Prefix, backfilledAt)
+		return err
+	})
+}
+
+/* keys in [after, before) in listing order */
+func dbIndexedKeys(ctx context.Context, bucket string, after string, before string) ([]string, error) {
+	var keys []string
+	err := dbRetry.do(ctx, "indexed keys", func (ctx context.Context) error {
+		keys = nil
+		rows, err := DB.QueryContext(ctx, "SELECT s3_key FROM uploads WHERE bucket=? AND s3_key > ? AND s3_key < ? ORDER BY s3_key", bucket, after, before)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return rows.Err()
+	})
+	return keys, err
+}
+
+type indexedUpload struct {
+	key        string
+	device     string
+	uploadedAt time.Time
+}
+
+func dbMeetingInstanceUploads(ctx context.Context, bucket string, id int64) ([]indexedUpload, error) {
+	var uploads []indexedUpload
+	err := dbRetry.do(ctx, "meeting uploads", func (ctx context.Context) error {
+		uploads = nil
+		rows, err := DB.QueryContext(ctx, "SELECT s3_key, device_id, uploaded_at FROM uploads WHERE bucket=? AND meeting_instance_id=? ORDER BY s3_key", bucket, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var upload indexedUpload
+			var device sql.NullString
+			if err := rows.Scan(&upload.key, &device, &upload.uploadedAt); err != nil {
+				return err
+			}
+			upload.device = device.String
+			uploads = append(uploads, upload)
+		}
+		return rows.Err()
+	})
+	return uploads, err
+}
+
+/* metadata, as uploadMetadata builds it, for an upload that is
+   yet to happen */
+func dbRecordUploadAttribution(ctx context.Context, tn *tenant, key string, metadata map[string]string) error {
+	var device, client sql.NullString
+	if value, ok := metadata[DeviceMetadataKey]; ok {
+		device = sql.NullString{ String: value, Valid: true }
+	}
+	if value, ok := metadata[ClientMetadataKey]; ok {
+		client = sql.NullString{ String: value, Valid: true }
+	}
+	var instance sql.NullInt64
+	if value, err := strconv.ParseInt(metadata[MeetingInstanceMetadataKey], 10, 64); err == nil {
+		instance = sql.NullInt64{ Int64: value, Valid: true }
+	}
+	return dbRetry.do(ctx, "record upload attribution", func (ctx context.Context) error {
+		_, err := DB.ExecContext(ctx, "INSERT INTO upload_attributions (bucket, s3_key, device_id, client, meeting_instance_id, created_at) VALUES (?, ?, ?, ?, ?, UTC_TIMESTAMP()) " +
+			"ON DUPLICATE KEY UPDATE device_id=VALUES(device_id), client=VALUES(client), meeting_instance_id=VALUES(meeting_instance_id), created_at=UTC_TIMESTAMP()",
+			tn.Bucket, tn.key(key), device, client, instance)
+		return err
+	})
+}
+
+/* the metadata recorded for an upload, empty if there is none */
+func dbUploadAttribution(ctx context.Context, tn *tenant, key string) (map[string]string, error) {
+	var device, client sql.NullString
+	var instance sql.NullInt64
+	err := dbRetry.do(ctx, "upload attribution", func (ctx context.Context) error {
+		return DB.QueryRowContext(ctx, "SELECT device_id, client, meeting_instance_id FROM upload_attributions WHERE bucket=? AND s3_key=?", tn.Bucket, tn.key(key)).Scan(&device, &client, &instance)
+	})
+	metadata := map[string]string{}
+	if err == sql.ErrNoRows {
+		return metadata, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if device.Valid {
+		metadata[DeviceMetadataKey] = device.String
+	}
+	if client.Valid {
+		metadata[ClientMetadataKey] = client.String
+	}
+	if instance.Valid {
+		metadata[MeetingInstanceMetadataKey] = strconv.FormatInt(instance.Int64, 10)
+	}
+	return metadata, nil
+}
+
+/* 0 if the device has no organization */
+func dbDeviceOrganization(ctx context.Context, deviceId string) (int64, error) {
+	var org sql.NullInt64
+	err := dbRetry.do(ctx, "device organization", func (ctx context.Context) error {
+		return DB.QueryRowContext(ctx, "SELECT organization_id FROM device WHERE id=?", deviceId).Scan(&org)
+	})
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return org.Int64, nil
+}
+
+type purgeRun struct {
+	id      int64
+	jobId   int64
+	kind    string
+	tenant  string
+	dryRun  bool
+	objects int
+	bytes   int64
+	failed  int
+	message string
+}
+
+func dbStartPurgeRun(ctx context.Context, run *purgeRun) error {
+	return dbRetry.do(ctx, "start purge run", func (ctx context.Context) error {
+		var jobId sql.NullInt64
+		if run.jobId != 0 {
+			jobId = sql.NullInt64{ Int64: run.jobId, Valid: true }
+		}
+		result, err := DB.ExecContext(ctx, "INSERT INTO log_purge_runs (kind, tenant, job_id, dry_run, started_at) VALUES (?, ?, ?, ?, UTC_TIMESTAMP())",
+			run.kind, run.tenant, jobId, run.dryRun)
+		if err != nil {
+			return err
+		}
+		run.id, err = result.LastInsertId()
+		return err
+	})
+}
+
+/* like dbStartPurgeRun, but only if no run of the same kind for the
+   tenant has started within interval; false if one has. Two servers
+   can still both get in, which costs a second listing and nothing
+   else. */
+func dbClaimPurgeRun(ctx context.Context, run *purgeRun, interval time.Duration) (bool, error) {
+	err := dbRetry.do(ctx, "claim purge run", func (ctx context.Context) error {
+		run.id = 0
+		result, err := DB.ExecContext(ctx, "INSERT INTO log_purge_runs (kind, tenant, dry_run, started_at) SELECT ?, ?, ?, UTC_TIMESTAMP() FROM DUAL " +
+			"WHERE NOT EXISTS (SELECT 1 FROM log_purge_runs WHERE kind=? AND tenant=? AND started_at > ?)",
+			run.kind, run.tenant, run.dryRun, run.kind, run.tenant, time.Now().UTC().Add(-interval))
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		run.id, err = result.LastInsertId()
+		return err
+	})
+	return run.id != 0, err
+}
+
+func dbFinishPurgeRun(ctx context.Context, run *purgeRun) error {
+	return dbRetry.do(ctx, "finish purge run", func (ctx context.Context) error {
+		_, err := DB.ExecContext(ctx, "UPDATE log_purge_runs SET objects=?, bytes=?, failed=?, message=?, finished_at=UTC_TIMESTAMP() WHERE id=?",
+			run.objects, run.bytes, run.failed, run.message, run.id)
+		return err
+	})
+}
+
+type purgedObject struct {
+	key          string
+	class        string
+	size         int64
+	lastModified time.Time
+}
+
+/* the audit trail: one row per object deleted by the run, and the
+   objects are dropped from the upload index */
+func dbRecordPurges(ctx context.Context, runId int64, tn *tenant, objects []purgedObject) error {
+	if len(objects) == 0 {
+		return nil
+	}
+	query := "INSERT INTO log_purges (run_id, bucket, s3_key, class, size, last_modified, purged_at) VALUES "
+	var args []interface{}
+	keys := make([]interface{}, 0, len(objects) + 1)
+	keys = append(keys, tn.Bucket)
+	for i, object := range objects {
+		if i > 0 {
+			query += ", "
+		}
+		query += "(?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())"
+		args = append(args, runId, tn.Bucket, tn.key(object.key), object.class, object.size, object.lastModified.UTC())
+		keys = append(keys, tn.key(object.key))
+	}
+	forget := "DELETE FROM uploads WHERE bucket=? AND s3_key IN (?" + strings.Repeat(", ?", len(objects) - 1) + ")"
+	return dbRetry.do(ctx, "record purges", func (ctx context.Context) error {
+		tx, err := DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, forget, keys...); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+/* uploads the index attributes to device, whatever their key */
+func dbDeviceUploads(ctx context.Context, bucket string, deviceId string) ([]purgedObject, error) {
+	var uploads []purgedObject
+	err := dbRetry.do(ctx, "device uploads", func (ctx context.Context) error {
+		uploads = nil
+		rows, err := DB.QueryContext(ctx, "SELECT s3_key, size, uploaded_at FROM uploads WHERE bucket=? AND device_id=? ORDER BY s3_key", bucket, deviceId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var upload purgedObject
+			if err := rows.Scan(&upload.key, &upload.size, &upload.lastModified); err != nil {
+				return err
+			}
+			uploads = append(uploads, upload)
+		}
+		return rows.Err()
+	})
+	return uploads, err
+}
+
+func dbQueryForStrings(ctx context.Context, what string, query string, args ...interface{}) ([]string, error) {
+	var values []string
+	err := dbRetry.do(ctx, what, func (ctx context.Context) error {
+		values = nil
+		rows, err := DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var value string
+			if err := rows.Scan(&value); err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+		return rows.Err()
+	})
+	return values, err
+}
+
+func dbUserDevices(ctx context.Context, userId int64) ([]string, error) {
+	return dbQueryForStrings(ctx, "user devices", "SELECT id FROM device WHERE user_id=?", userId)
+}
+
+func dbDeviceDownloadTokens(ctx context.Context, deviceId string) ([]string, error) {
+	return dbQueryForStrings(ctx, "device download tokens", "SELECT token FROM launch_tokens WHERE device_id=?", deviceId)
+}
+
+type erasureJob struct {
+	id        int64
+	state     string
+	params    string
+	objects   int
+	bytes     int64
+	failed    int
+	message   string
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+/* params of the erasures that are queued or running, or were
+   queued since since */
+func dbErasureParamsSince(ctx context.Context, since time.Time) ([]string, error) {
+	return dbQueryForStrings(ctx, "recent erasure jobs", "SELECT params FROM log_erasure_jobs WHERE state IN ('Queued', 'Running') OR created_at >= ?", since)
+}
+
+func dbCreateErasureJob(ctx context.Context, params string) (int64, error) {
+	var id int64
+	err := dbRetry.do(ctx, "create erasure job", func (ctx context.Context) error {
+		result, err := DB.ExecContext(ctx, "INSERT INTO log_erasure_jobs (state, params, created_at, updated_at) VALUES ('Queued', ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())", params)
+		if err != nil {
+			return err
+		}
+		id, err = result.LastInsertId()
+		return err
+	})
+	return id, err
+}
+
+func dbGetErasureJob(ctx context.Context, id int64) (*erasureJob, error) {
+	job := &erasureJob{ id: id }
+	var message sql.NullString
+	var createdAt, updatedAt mysql.NullTime
+	err := dbRetry.do(ctx, "erasure job", func (ctx context.Context) error {
+		return DB.QueryRowContext(ctx, "SELECT state, params, objects, bytes, failed, message, created_at, updated_at FROM log_erasure_jobs WHERE id=?", id).Scan(
+			&job.state, &job.params, &job.objects, &job.bytes, &job.failed, &message, &createdAt, &updatedAt)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	job.message = message.String
+	job.createdAt = createdAt.Time
+	job.updatedAt = updatedAt.Time
+	return job, nil
+}
+
+/* as dbClaimExportJob */
+func dbClaimErasureJob(ctx context.Context) (*erasureJob, error) {
+	for {
+		var id int64
+		err := dbRetry.do(ctx, "queued erasure job", func (ctx context.Context) error {
+			return DB.QueryRowContext(ctx, "SELECT id FROM log_erasure_jobs WHERE state='Queued' ORDER BY id LIMIT 1").Scan(&id)
+		})
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var claimed int64
+		err = dbRetry.do(ctx, "claim erasure job", func (ctx context.Context) error {
+			result, err := DB.ExecContext(ctx, "UPDATE log_erasure_jobs SET state='Running', updated_at=UTC_TIMESTAMP() WHERE id=? AND state='Queued'", id)
+			if err != nil {
+				return err
+			}
+			claimed, err = result.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if claimed == 1 {
+			return dbGetErasureJob(ctx, id)
+		}
+	}
+}
+
+/* also the heartbeat of a running job */
+func dbUpdateErasureJob(ctx context.Context, job *erasureJob) error {
+	return dbRetry.do(ctx, "update erasure job", func (ctx context.Context) error {
+		_, err := DB.ExecContext(ctx, "UPDATE log_erasure_jobs SET state=?, objects=?, bytes=?, failed=?, message=?, updated_at=UTC_TIMESTAMP() WHERE id=?",
+			job.state, job.objects, job.bytes, job.failed, job.message, job.id)
+		return err
+	})
+}
+
+/* jobs left Running by a server that went away; erasing again is
+   harmless, what is already gone stays gone */
+func dbRequeueStaleErasureJobs(ctx context.Context, staleAfter time.Duration) (int64, error) {
+	var requeued int64
+	err := dbRetry.do(ctx, "requeue erasure jobs", func (ctx context.Context) error {
+		result, err := DB.ExecContext(ctx, "UPDATE log_erasure_jobs SET state='Queued', updated_at=UTC_TIMESTAMP() WHERE state='Running' AND updated_at < ?", time.Now().UTC().Add(-staleAfter))
+		if err != nil {
+			return err
+		}
+		requeued, err = result.RowsAffected()
+		return err
+	})
+	return requeued, err
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+/* Envelope encryption of logs we store ourselves, for tenants with
+   envelope set. Each object gets its own AES-256 data key from KMS;
+   the object is
+
+     envelopeMagic
+     2 bytes   length of the encrypted data key
+     n bytes   encrypted data key, as KMS returned it
+     4 bytes   nonce prefix
+     segments
+
+   and each segment is up to EnvelopeSegmentSize bytes of plaintext
+   sealed with AES-GCM. The nonce is the prefix followed by the
+   segment number and the additional data says whether it is the
+   last segment, so segments cannot be reordered, dropped or cut
+   off at the end without failing to open. The data key is bound to
+   the tenant through the KMS encryption context.
+
+   Readers don't need to know which objects are encrypted; anything
+   that starts with envelopeMagic is.
+
+   Only what queueLog writes is ever enveloped: the /inbound/ logs
+   posted to /v1/logs and /v2/logs. In here they are read through
+   openLogArchive, by meeting retrieval and exports. Anything else
+   that reads /inbound/ gets ciphertext and has to go through
+   "logprocessor decrypt". Uploads made with presigned URLs are
+   written by S3 itself and export zips are not logs we store, so
+   neither is enveloped; they rely on the bucket's encryption. */
+
+const (
+	envelopeMagic = "feedmicro-envelope 1\n"
+	EnvelopeSegmentSize = 64 << 10
+)
+
+func envelopeContext(tn *tenant) map[string]*string {
+	return map[string]*string{ "tenant": aws.String(tn.Name) }
+}
+
+func segmentNonce(prefix []byte, seq uint64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func segmentAdditionalData(last bool) []byte {
+	if last {
+		return []byte{ 1 }
+	}
+	return []byte{ 0 }
+}
+
+type envelopeWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint64
+	buf    []byte
+}
+
+/* where data keys come from: a new one as plaintext and encrypted,
+   and the plaintext of an encrypted one. KMS, unless a test has
+   swapped them out. */
+var (
+	generateEnvelopeKey = kmsGenerateEnvelopeKey
+	decryptEnvelopeKey = kmsDecryptEnvelopeKey
+)
+
+func kmsGenerateEnvelopeKey(ctx context.Context, tn *tenant) ([]byte, []byte, error) {
+	var dataKey *kms.GenerateDataKeyOutput
+	err := uploadRetry.do(ctx, "data key " + tn.Name, func (ctx context.Context) error {
+		var err error
+		dataKey, err = tn.clients().kms.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+			KeyId: aws.String(tn.KMSKeyId),
+			KeySpec: aws.String(kms.DataKeySpecAes256),
+			EncryptionContext: envelopeContext(tn),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey.Plaintext, dataKey.CiphertextBlob, nil
+}
+
+func kmsDecryptEnvelopeKey(ctx context.Context, tn *tenant, blob []byte) ([]byte, error) {
+	var dataKey *kms.DecryptOutput
+	err := downloadRetry.do(ctx, "data key " + tn.Name, func (ctx context.Context) error {
+		var err error
+		dataKey, err = tn.clients().kms.DecryptWithContext(ctx, &kms.DecryptInput{
+			CiphertextBlob: blob,
+			EncryptionContext: envelopeContext(tn),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dataKey.Plaintext, nil
+}
+
+/* the caller must Close the writer to write the last segment */
+func newEnvelopeWriter(ctx context.Context, tn *tenant, w io.Writer) (*envelopeWriter, error) {
+	plainKey, blob, err := generateEnvelopeKey(ctx, tn)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(plainKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if len(blob) > 0xffff {
+		return nil, fmt.Errorf("encrypted data key too long")
+	}
+	header := []byte(envelopeMagic)
+	header = append(header, byte(len(blob) >> 8), byte(len(blob)))
+	header = append(header, blob...)
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &envelopeWriter{ w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, EnvelopeSegmentSize) }, nil
+}
+
+func (ew *envelopeWriter) seal(last bool) error {
+	sealed := ew.aead.Seal(nil, segmentNonce(ew.prefix, ew.seq), ew.buf, segmentAdditionalData(last))
+	ew.seq++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+func (ew *envelopeWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		/* a full segment is only sealed once there is more, as
+		   until then it might be the last */
+		if len(ew.buf) == EnvelopeSegmentSize {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf) + n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *envelopeWriter) Close() error {
+	return ew.seal(true)
+}
+
+/* reads r through an envelope writer, for awsUpload; close it
+   if the upload gives up before reading to the end */
+func envelopeReader(ctx context.Context, tn *tenant, r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		ew, err := newEnvelopeWriter(ctx, tn, pw)
+		if err == nil {
+			_, err = io.Copy(ew, r)
+		}
+		if err == nil {
+			err = ew.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+type envelopeDecrypter struct {
+	br     *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint64
+	sealed []byte
+	plain  []byte
+	done   bool
+}
+
+func isEnvelope(data []byte) bool {
+	return len(data) >= len(envelopeMagic) && string(data[:len(envelopeMagic)]) == envelopeMagic
+}
+
+/* r must start with envelopeMagic */
+func newEnvelopeDecrypter(ctx context.Context, tn *tenant, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, EnvelopeSegmentSize + 64)
+	magic := make([]byte, len(envelopeMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != envelopeMagic {
+		return nil, fmt.Errorf("not an envelope")
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(br, size[:]); err != nil {
+		return nil, fmt.Errorf("truncated envelope: %w", err)
+	}
+	blob := make([]byte, int(size[0]) << 8 | int(size[1]))
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(br, blob); err != nil {
+		return nil, fmt.Errorf("truncated envelope: %w", err)
+	}
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, fmt.Errorf("truncated envelope: %w", err)
+	}
+	plainKey, err := decryptEnvelopeKey(ctx, tn, blob)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(plainKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &envelopeDecrypter{
+		br: br,
+		aead: aead,
+		prefix: prefix,
+		sealed: make([]byte, EnvelopeSegmentSize + aead.Overhead()),
+	}, nil
+}
+
+func decryptEnvelope(ctx context.Context, tn *tenant, data []byte) ([]byte, error) {
+	r, err := newEnvelopeDecrypter(ctx, tn, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (ed *envelopeDecrypter) Read(p []byte) (int, error) {
+	for len(ed.plain) == 0 {
+		if ed.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(ed.br, ed.sealed)
+		last := false
+		switch {
+			case err == io.ErrUnexpectedEOF:
+				last = true
+			case err == io.EOF:
+				return 0, fmt.Errorf("envelope cut off after segment %d", ed.seq)
+			case err != nil:
+				return 0, err
+			default:
+				if _, err := ed.br.Peek(1); err == io.EOF {
+					last = true
+				} else if err != nil {
+					return 0, err
+				}
+		}
+		plain, err := ed.aead.Open(ed.sealed[:0:0], segmentNonce(ed.prefix, ed.seq), ed.sealed[:n], segmentAdditionalData(last))
+		if err != nil {
+			return 0, fmt.Errorf("envelope segment %d: %w", ed.seq, err)
+		}
+		ed.seq++
+		ed.plain = plain
+		ed.done = last
+	}
+	n := copy(p, ed.plain)
+	ed.plain = ed.plain[n:]
+	return n, nil
+}
+
+/* "logprocessor decrypt [-tenant T] key" writes the plaintext of a
+   stored log to stdout, for consumers of /inbound/ outside this
+   service; objects that aren't enveloped come out as they are */
+func runDecrypt(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	name := flags.String("tenant", defaultTenant.Name, "tenant the object belongs to")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: decrypt [-tenant T] key")
+	}
+	tn := tenantByName(*name)
+	if tn == nil {
+		return fmt.Errorf("no tenant %s", *name)
+	}
+	key := flags.Arg(0)
+	buff, _, err := awsDownload(ctx, tn, key)
+	if err != nil {
+		return err
+	}
+	if isEnvelope(buff) {
+		buff, err = decryptEnvelope(ctx, tn, buff)
+		if err != nil {
+			return fmt.Errorf("could not decrypt %s: %w", key, err)
+		}
+	}
+	_, err = os.Stdout.Write(buff)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+/* data keys without KMS: the "encrypted" key names the tenant, so
+   opening another tenant's envelope fails as it would with KMS */
+func useTestEnvelopeKeys(t *testing.T) {
+	plainKey := bytes.Repeat([]byte{ 7 }, 32)
+	generateEnvelopeKey = func (ctx context.Context, tn *tenant) ([]byte, []byte, error) {
+		return plainKey, []byte("key for " + tn.Name), nil
+	}
+	decryptEnvelopeKey = func (ctx context.Context, tn *tenant, blob []byte) ([]byte, error) {
+		if string(blob) != "key for " + tn.Name {
+			return nil, fmt.Errorf("data key is not %s's", tn.Name)
+		}
+		return plainKey, nil
+	}
+	t.Cleanup(func () {
+		generateEnvelopeKey = kmsGenerateEnvelopeKey
+		decryptEnvelopeKey = kmsDecryptEnvelopeKey
+	})
+}
+
+const envelopeTagSize = 16
+
+func envelopeHeaderSize(tn *tenant) int {
+	return len(envelopeMagic) + 2 + len("key for " + tn.Name) + 4
+}
+
+func testPlaintext(size int) []byte {
+	plain := make([]byte, size)
+	for i := range plain {
+		plain[i] = byte(i * 31 + i / 251)
+	}
+	return plain
+}
+
+func sealEnvelope(t *testing.T, tn *tenant, plain []byte) []byte {
+	sealed, err := ioutil.ReadAll(envelopeReader(context.Background(), tn, bytes.NewReader(plain)))
+	if err != nil {
+		t.Fatalf("sealing %d bytes: %s", len(plain), err)
+	}
+	return sealed
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	useTestEnvelopeKeys(t)
+	tn := &tenant{ Name: "t" }
+	tests := []struct {
+		name     string
+		size     int
+		segments int
+	}{
+		{ "empty", 0, 1 },
+		{ "one byte", 1, 1 },
+		{ "just under a segment", EnvelopeSegmentSize - 1, 1 },
+		{ "exactly one segment", EnvelopeSegmentSize, 1 },
+		{ "just over a segment", EnvelopeSegmentSize + 1, 2 },
+		{ "exactly two segments", 2 * EnvelopeSegmentSize, 2 },
+		{ "two and a bit", 2 * EnvelopeSegmentSize + 7, 3 },
+	}
+	for _, test := range tests {
+		plain := testPlaintext(test.size)
+		sealed := sealEnvelope(t, tn, plain)
+		if !isEnvelope(sealed) {
+			t.Errorf("%s: not recognised as an envelope", test.name)
+			continue
+		}
+		if want := envelopeHeaderSize(tn) + test.size + test.segments * envelopeTagSize; len(sealed) != want {
+			t.Errorf("%s: %d bytes sealed, want %d (%d segments)", test.name, len(sealed), want, test.segments)
+		}
+		opened, err := decryptEnvelope(context.Background(), tn, sealed)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(opened, plain) {
+			t.Errorf("%s: got %d bytes back, not the %d sealed", test.name, len(opened), len(plain))
+		}
+	}
+}
+
+func TestEnvelopeTampering(t *testing.T) {
+	useTestEnvelopeKeys(t)
+	tn := &tenant{ Name: "t" }
+	header := envelopeHeaderSize(tn)
+	segment := EnvelopeSegmentSize + envelopeTagSize
+	/* three segments, the last one short */
+	three := sealEnvelope(t, tn, testPlaintext(2 * EnvelopeSegmentSize + 7))
+	/* two full segments */
+	two := sealEnvelope(t, tn, testPlaintext(2 * EnvelopeSegmentSize))
+	empty := sealEnvelope(t, tn, nil)
+	seg := func (sealed []byte, i int) []byte {
+		end := header + (i + 1) * segment
+		if end > len(sealed) {
+			end = len(sealed)
+		}
+		return sealed[header + i * segment:end]
+	}
+	join := func (parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	flipped := append([]byte(nil), three...)
+	flipped[header + segment + 5] ^= 1
+	tests := []struct {
+		name   string
+		sealed []byte
+		tn     *tenant
+	}{
+		{ "cut inside the header", three[:header - 2], tn },
+		{ "cut after the header", three[:header], tn },
+		{ "empty envelope without its segment", empty[:header], tn },
+		{ "empty envelope cut inside its segment", empty[:len(empty) - 1], tn },
+		{ "last segment dropped", three[:header + 2 * segment], tn },
+		{ "cut inside the last segment", three[:len(three) - 3], tn },
+		{ "cut inside a full segment", three[:header + segment + 100], tn },
+		{ "last full segment dropped at a boundary", two[:header + segment], tn },
+		{ "first two segments swapped", join(three[:header], seg(three, 1), seg(three, 0), seg(three, 2)), tn },
+		{ "middle segment dropped", join(three[:header], seg(three, 0), seg(three, 2)), tn },
+		{ "middle segment repeated", join(three[:header], seg(three, 0), seg(three, 1), seg(three, 1), seg(three, 2)), tn },
+		{ "full segments swapped", join(two[:header], seg(two, 1), seg(two, 0)), tn },
+		{ "a bit flipped", flipped, tn },
+		{ "another tenant's envelope", three, &tenant{ Name: "u" } },
+	}
+	for _, test := range tests {
+		opened, err := decryptEnvelope(context.Background(), test.tn, test.sealed)
+		if err == nil {
+			t.Errorf("%s: opened to %d bytes", test.name, len(opened))
+		}
+	}
+}
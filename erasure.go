@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Erasure of everything a device uploaded, for data-subject
+   deletion requests. POST /v1/admin/erasures takes one or more
+   device_id, or a user_id standing for all of that user's devices,
+   and queues a job; GET /v1/admin/erasures?id=N reports on it.
+   Both need the admin token, see checkAdminToken.
+
+   A job deletes, in every tenant:
+
+     <device>/...                  the normal layout
+     download/<token>/...          for each of the device's launch tokens
+     anything the upload index attributes to the device
+     /inbound/...                  logs the device posted to /v1/logs
+     exports/<id>.zip              exports holding any of the above
+
+   /inbound/ keys say nothing about the device, so it is listed and
+   the metadata of every object the index does not attribute to the
+   device is checked. That takes a long time on a big bucket;
+   scan=false skips it and relies on the index, which has the posts
+   made since queueLog started indexing them but may miss older ones.
+   With dry_run=true nothing is deleted, only counted.
+
+   Each tenant's deletions are a purge run of kind "erasure" with
+   the job's id, and every object deleted is in log_purges, see
+   purge.go. The devices are resolved when the job is queued and
+   kept in its params, so the job row records whose data it was. */
+
+const (
+	ErasurePollIntervalInSeconds = 5
+	ErasureStaleAfterInMinutes = 30
+)
+
+var erasureWake = make(chan struct{}, 1)
+
+type erasureJobResponse struct {
+	Id        int64    `json:"id"`
+	State     string   `json:"state"`
+	Message   string   `json:"message,omitempty"`
+	Devices   []string `json:"devices"`
+	DryRun    bool     `json:"dry_run"`
+	Objects   int      `json:"objects"`
+	Bytes     int64    `json:"bytes"`
+	Failed    int      `json:"failed"`
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at,omitempty"`
+}
+
+func erasureAdmin(req *http.Request) bool {
+	if !checkAdminToken(req) {
+		log.Printf("WARN: erasure request without a valid admin token from %s", req.RemoteAddr)
+		return false
+	}
+	return true
+}
+
+func erasurePost(req *http.Request) func(http.ResponseWriter) {
+	if !erasureAdmin(req) {
+		return httpForbidden
+	}
+	ctx := req.Context()
+	q := req.URL.Query()
+	var err error
+	var userId int64
+	var dryRun bool
+	scan := true
+	queryInt64Item(q, "user_id", &userId, &err)
+	queryBoolItem(q, "dry_run", &dryRun, &err)
+	queryBoolItem(q, "scan", &scan, &err)
+	if err != nil {
+		log.Printf("ERROR: malformed query: %s", err)
+		return httpBadRequest
+	}
+	devices := q["device_id"]
+	if userId != 0 {
+		userDevices, err := dbUserDevices(ctx, userId)
+		if err != nil {
+			log.Printf("ERROR: could not look up devices of user %d: %s", userId, err)
+			return httpInternalServerError
+		}
+		devices = append(devices, userDevices...)
+	}
+	if len(devices) == 0 {
+		log.Printf("ERROR: erasure without devices")
+		return httpBadRequest
+	}
+	/* a device id is a key prefix; anything else could match
+	   far more than the device */
+	for _, device := range devices {
+		if err := checkKeySegment("device_id", device, MaxKeySegmentLength); err != nil {
+			log.Printf("ERROR: %s", err)
+			return httpBadRequest
+		}
+	}
+	params := url.Values{ "device_id": devices }
+	if userId != 0 {
+		params.Set("user_id", strconv.FormatInt(userId, 10))
+	}
+	params.Set("dry_run", strconv.FormatBool(dryRun))
+	params.Set("scan", strconv.FormatBool(scan))
+	id, err := dbCreateErasureJob(ctx, params.Encode())
+	if err != nil {
+		log.Printf("ERROR: could not create erasure job: %s", err)
+		return httpInternalServerError
+	}
+	log.Printf("INFO: queued erasure job %d for %d devices", id, len(devices))
+	select {
+		case erasureWake <- struct{}{}:
+		default:
+	}
+	respond := jsonResponse(&erasureJobResponse{
+		Id: id,
+		State: "Queued",
+		Devices: devices,
+		DryRun: dryRun,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		respond(w)
+	}
+}
+
+func erasureGet(req *http.Request) func(http.ResponseWriter) {
+	if !erasureAdmin(req) {
+		return httpForbidden
+	}
+	var err error
+	var id int64
+	queryInt64Item(req.URL.Query(), "id", &id, &err)
+	if err != nil || id == 0 {
+		log.Printf("ERROR: missing or malformed erasure id")
+		return httpBadRequest
+	}
+	job, err := dbGetErasureJob(req.Context(), id)
+	if err != nil {
+		log.Printf("ERROR: could not read erasure job %d: %s", id, err)
+		return httpInternalServerError
+	}
+	if job == nil {
+		return httpNotFound
+	}
+	q, _ := url.ParseQuery(job.params)
+	dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+	return jsonResponse(&erasureJobResponse{
+		Id: job.id,
+		State: job.state,
+		Message: job.message,
+		Devices: q["device_id"],
+		DryRun: dryRun,
+		Objects: job.objects,
+		Bytes: job.bytes,
+		Failed: job.failed,
+		CreatedAt: job.createdAt.Format(time.RFC3339),
+		UpdatedAt: job.updatedAt.Format(time.RFC3339),
+	})
+}
+
+/* queues every object of devices in tn with p, at most once.
+   Everything found here is the devices', whether or not retention
+   knows its layout, so keys without a class are erased as "other". */
+func eraseDevices(ctx context.Context, tn *tenant, p *purger, devices []string, scan bool) error {
+	seen := map[string]bool{}
+	erase := func (key string, size int64, lastModified time.Time) error {
+		if seen[key] || isInternalKey(key) {
+			return nil
+		}
+		/* other tenants may live under prefixes of ours */
+		if owner, _ := tenantForObject(tn.Bucket, tn.key(key)); owner != tn {
+			return nil
+		}
+		seen[key] = true
+		class := retentionClass(key)
+		if class == "" {
+			class = "other"
+		}
+		return p.add(ctx, purgedObject{ key: key, class: class, size: size, lastModified: lastModified })
+	}
+	eraseListed := func (prefix string) error {
+		var failed error
+		err := awsListObjects(ctx, tn, prefix, "", func (key string, info *awsObjectInfo) bool {
+			failed = erase(key, info.size, info.lastModified)
+			return failed == nil
+		})
+		if err == nil {
+			err = failed
+		}
+		return err
+	}
+	isDevice := map[string]bool{}
+	isToken := map[string]bool{}
+	for _, device := range devices {
+		isDevice[device] = true
+		if err := eraseListed(device + "/"); err != nil {
+			return err
+		}
+		tokens, err := dbDeviceDownloadTokens(ctx, device)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			isToken[token] = true
+			if checkKeySegment("download_token", token, MaxKeySegmentLength) != nil {
+				continue
+			}
+			if err := eraseListed("download/" + token + "/"); err != nil {
+				return err
+			}
+		}
+		uploads, err := dbDeviceUploads(ctx, tn.Bucket, device)
+		if err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			owner, key := tenantForObject(tn.Bucket, upload.key)
+			if owner != tn {
+				continue
+			}
+			if err := erase(key, upload.size, upload.lastModified); err != nil {
+				return err
+			}
+		}
+	}
+	if scan {
+		var failed error
+		checked := 0
+		err := awsListObjects(ctx, tn, "/inbound/", "", func (key string, _ *awsObjectInfo) bool {
+			if seen[key] {
+				return true
+			}
+			/* keeps the job from looking stale while nothing
+			   matches */
+			if checked++; checked % MaxDeleteBatch == 0 && p.progress != nil {
+				p.progress(ctx)
+			}
+			info, err := awsHead(ctx, tn, key)
+			if err != nil {
+				if !isRetryable(err) {
+					/* gone since it was listed */
+					return true
+				}
+				failed = err
+				return false
+			}
+			if isDevice[info.metadata[DeviceMetadataKey]] {
+				failed = erase(key, info.size, info.lastModified)
+			}
+			return failed == nil
+		})
+		if err == nil {
+			err = failed
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := p.flush(ctx); err != nil {
+		return err
+	}
+	return eraseExports(ctx, tn, p, isDevice, isToken)
+}
+
+/* whether the zip of job may hold logs of the devices, or logs
+   uploaded with their download tokens; meeting exports written
+   before the devices were recorded with the job are assumed to */
+func exportCovers(job *exportJob, isDevice map[string]bool, isToken map[string]bool) bool {
+	q, _ := url.ParseQuery(job.params)
+	if token := q.Get("download_token"); token != "" && isToken[token] {
+		return true
+	}
+	if job.devices == nil {
+		return isMeetingExport(q) || isDevice[q.Get("token")]
+	}
+	for _, device := range strings.Fields(*job.devices) {
+		if isDevice[device] {
+			return true
+		}
+	}
+	return false
+}
+
+/* queues the export zips in tn that hold logs of the devices; the
+   jobs read as expired once their zip is gone */
+func eraseExports(ctx context.Context, tn *tenant, p *purger, isDevice map[string]bool, isToken map[string]bool) error {
+	jobs, err := dbStoredExportJobs(ctx)
+	if err != nil {
+		return err
+	}
+	jobIds := map[string]int64{}
+	for i := range jobs {
+		job := &jobs[i]
+		q, _ := url.ParseQuery(job.params)
+		if q.Get("tenant") != tn.Name || !exportCovers(job, isDevice, isToken) {
+			continue
+		}
+		info, err := awsHead(ctx, tn, job.s3Key)
+		if err != nil {
+			if isRetryable(err) {
+				return err
+			}
+			/* already gone */
+			if !p.run.dryRun {
+				if err := dbEraseExportObject(ctx, job.id); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		jobIds[job.s3Key] = job.id
+		if err := p.add(ctx, purgedObject{ key: job.s3Key, class: "export", size: info.size, lastModified: info.lastModified }); err != nil {
+			return err
+		}
+	}
+	p.deleted = func (ctx context.Context, object purgedObject) error {
+		if id, ok := jobIds[object.key]; ok {
+			return dbEraseExportObject(ctx, id)
+		}
+		return nil
+	}
+	defer func() { p.deleted = nil }()
+	return p.flush(ctx)
+}
+
+/* an export that ran alongside an erasure of one of its devices
+   may have read logs the erasure had not got to yet, and finished
+   after the erasure looked for exports, so it looks for erasures */
+func eraseExportIfErased(ctx context.Context, job *exportJob) {
+	params, err := dbErasureParamsSince(ctx, job.createdAt)
+	if err != nil {
+		log.Printf("ERROR: could not check export %d against erasures: %s", job.id, err)
+		return
+	}
+	for _, param := range params {
+		q, err := url.ParseQuery(param)
+		if err != nil {
+			continue
+		}
+		if dryRun, _ := strconv.ParseBool(q.Get("dry_run")); dryRun {
+			continue
+		}
+		isDevice := map[string]bool{}
+		isToken := map[string]bool{}
+		for _, device := range q["device_id"] {
+			isDevice[device] = true
+			tokens, err := dbDeviceDownloadTokens(ctx, device)
+			if err != nil {
+				log.Printf("ERROR: could not check export %d against erasures: %s", job.id, err)
+				return
+			}
+			for _, token := range tokens {
+				isToken[token] = true
+			}
+		}
+		if !exportCovers(job, isDevice, isToken) {
+			continue
+		}
+		eq, _ := url.ParseQuery(job.params)
+		tn := tenantByName(eq.Get("tenant"))
+		if tn == nil {
+			log.Printf("ERROR: export %d is for unknown tenant %s", job.id, eq.Get("tenant"))
+			return
+		}
+		failed, err := awsDeleteObjects(ctx, tn, []string{ job.s3Key })
+		if err == nil && failed[job.s3Key] != "" {
+			err = fmt.Errorf("%s", failed[job.s3Key])
+		}
+		if err == nil {
+			err = dbEraseExportObject(ctx, job.id)
+		}
+		if err != nil {
+			log.Printf("ERROR: could not erase export %d: %s", job.id, err)
+			return
+		}
+		log.Printf("INFO: erased export %d, its devices were erased while it ran", job.id)
+		return
+	}
+}
+
+func runErasureJob(ctx context.Context, job *erasureJob) {
+	log.Printf("INFO: running erasure job %d", job.id)
+	/* counts start over if the job was requeued */
+	job.objects, job.bytes, job.failed = 0, 0, 0
+	err := func() error {
+		q, err := url.ParseQuery(job.params)
+		if err != nil {
+			return err
+		}
+		var dryRun bool
+		scan := true
+		queryBoolItem(q, "dry_run", &dryRun, &err)
+		queryBoolItem(q, "scan", &scan, &err)
+		if err != nil {
+			return err
+		}
+		for _, tn := range allTenants() {
+			run := &purgeRun{ kind: "erasure", tenant: tn.Name, jobId: job.id, dryRun: dryRun }
+			if err := dbStartPurgeRun(ctx, run); err != nil {
+				return err
+			}
+			objects, bytes, failed := job.objects, job.bytes, job.failed
+			p := &purger{ tn: tn, run: run }
+			p.progress = func (ctx context.Context) {
+				job.objects = objects + run.objects
+				job.bytes = bytes + run.bytes
+				job.failed = failed + run.failed
+				if err := dbUpdateErasureJob(ctx, job); err != nil {
+					log.Printf("WARN: could not update erasure job %d: %s", job.id, err)
+				}
+			}
+			err := eraseDevices(ctx, tn, p, q["device_id"], scan)
+			finishPurgeRun(ctx, run, err)
+			if err != nil {
+				return fmt.Errorf("%s: %w", tn.Name, err)
+			}
+		}
+		return nil
+	}()
+	if ctx.Err() != nil {
+		/* left Running; another server requeues it once stale */
+		log.Printf("WARN: erasure job %d interrupted by shutdown", job.id)
+		return
+	}
+	switch {
+		case err != nil:
+			log.Printf("ERROR: erasure job %d failed: %s", job.id, err)
+			job.state = "Failed"
+			job.message = oneLine(err.Error())
+		case job.failed > 0:
+			job.state = "Failed"
+			job.message = fmt.Sprintf("%d objects could not be deleted", job.failed)
+		default:
+			job.state = "Done"
+			job.message = ""
+	}
+	log.Printf("INFO: erasure job %d %s: %d objects, %d bytes, %d failed", job.id, job.state, job.objects, job.bytes, job.failed)
+	if err := dbUpdateErasureJob(ctx, job); err != nil {
+		log.Printf("ERROR: could not record erasure job %d: %s", job.id, err)
+	}
+}
+
+/* runs queued jobs one at a time until ctx is done */
+func runErasureWorker(ctx context.Context) {
+	ticker := time.NewTicker(ErasurePollIntervalInSeconds * time.Second)
+	defer ticker.Stop()
+	for {
+		if n, err := dbRequeueStaleErasureJobs(ctx, ErasureStaleAfterInMinutes * time.Minute); err != nil {
+			log.Printf("ERROR: could not requeue stale erasure jobs: %s", err)
+		} else if n > 0 {
+			log.Printf("WARN: requeued %d stale erasure jobs", n)
+		}
+		for ctx.Err() == nil {
+			job, err := dbClaimErasureJob(ctx)
+			if err != nil {
+				log.Printf("ERROR: could not claim erasure job: %s", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			runErasureJob(ctx, job)
+		}
+		select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-erasureWake:
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/* Export jobs: POST /v1/log_exports takes the same query as
+   GET /v1/logs (token, download_token or client), or as
+   GET /v1/meeting_logs (instance_id alone), and queues a job.
+   A worker writes the result as a zip to exports/<id>.zip in the
+   tenant's bucket, and GET /v1/log_exports?id=N&ticket=T hands out
+   a presigned URL for it until the job expires; the zip is deleted
+   after that. Ids are sequential, so the random ticket returned by
+   the POST is what lets the requester, and nobody else, see the
+   job. The tenant and the caller's redaction policy are resolved
+   when the job is queued and kept in its params; the devices whose
+   logs went into the zip are recorded with it for erasures, see
+   eraseExports. */
+
+const (
+	ExportPollIntervalInSeconds = 5
+	ExportExpiryInHours = 24
+	MaxExportDurationInMinutes = 60
+	ExportStaleAfterInMinutes = 2 * MaxExportDurationInMinutes
+	ExportTicketBytes = 16
+	ExportCleanupBatch = 100
+)
+
+var exportWake = make(chan struct{}, 1)
+
+type exportJobResponse struct {
+	Id        int64  `json:"id"`
+	Ticket    string `json:"ticket,omitempty"`
+	State     string `json:"state"`
+	Message   string `json:"message,omitempty"`
+	Archives  int    `json:"archives"`
+	Skipped   string `json:"skipped,omitempty"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+func isMeetingExport(q url.Values) bool {
+	return q.Get("token") == "" && q.Get("download_token") == "" && q.Get("client") == ""
+}
+
+/* validates the query now, so a bad request fails here rather
+   than in the worker */
+func logExportPost(req *http.Request) func(http.ResponseWriter) {
+	ctx := req.Context()
+	q := req.URL.Query()
+	var fail func(http.ResponseWriter)
+	device := ""
+	if isMeetingExport(q) {
+		_, fail = readMeetingLogsOperation(ctx, q)
+	} else {
+		var glo getLogsOperation
+		glo, fail = readGetLogsOperation(ctx, q)
+		if fail == nil && glo.follow {
+			log.Printf("ERROR: exports cannot follow")
+			fail = httpBadRequest
+		}
+		device = glo.device()
+	}
+	if fail != nil {
+		return fail
+	}
+	tn, err := requestTenant(ctx, req, device)
+	if err != nil {
+		log.Printf("ERROR: could not resolve tenant: %s", err)
+		return httpInternalServerError
+	}
+	q.Set("tenant", tn.Name)
+	q.Set("redaction", requestRedactionPolicy(req))
+	ticket := make([]byte, ExportTicketBytes)
+	if _, err := io.ReadFull(rand.Reader, ticket); err != nil {
+		log.Printf("ERROR: could not make export ticket: %s", err)
+		return httpInternalServerError
+	}
+	id, err := dbCreateExportJob(ctx, q.Encode(), exportTicketHash(hex.EncodeToString(ticket)))
+	if err != nil {
+		log.Printf("ERROR: could not create export job: %s", err)
+		return httpInternalServerError
+	}
+	log.Printf("INFO: queued export job %d", id)
+	select {
+		case exportWake <- struct{}{}:
+		default:
+	}
+	respond := jsonResponse(&exportJobResponse{
+		Id: id,
+		Ticket: hex.EncodeToString(ticket),
+		State: "Queued",
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		respond(w)
+	}
+}
+
+func exportTicketHash(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:])
+}
+
+func logExportGet(req *http.Request) func(http.ResponseWriter) {
+	var err error
+	var id int64
+	var ticket string
+	queryInt64Item(req.URL.Query(), "id", &id, &err)
+	queryStringItem(req.URL.Query(), "ticket", &ticket)
+	if err != nil || id == 0 {
+		log.Printf("ERROR: missing or malformed export id")
+		return httpBadRequest
+	}
+	job, err := dbGetExportJob(req.Context(), id)
+	if err != nil {
+		log.Printf("ERROR: could not read export job %d: %s", id, err)
+		return httpInternalServerError
+	}
+	/* not telling a wrong ticket from a missing job */
+	if job == nil || job.ticketHash == "" ||
+	   subtle.ConstantTimeCompare([]byte(exportTicketHash(ticket)), []byte(job.ticketHash)) != 1 {
+		if job != nil {
+			log.Printf("WARN: export %d asked for with a wrong ticket", id)
+		}
+		return httpNotFound
+	}
+	resp := &exportJobResponse{
+		Id: job.id,
+		State: job.state,
+		Message: job.message,
+		Archives: job.archives,
+		Skipped: job.skipped,
+		CreatedAt: job.createdAt.Format(time.RFC3339),
+	}
+	if job.expiresAt != nil {
+		resp.ExpiresAt = job.expiresAt.Format(time.RFC3339)
+		if job.state == "Done" && !time.Now().Before(*job.expiresAt) {
+			/* the worker will catch up with this */
+			resp.State = "Expired"
+		}
+	}
+	if resp.State == "Done" {
+		q, _ := url.ParseQuery(job.params)
+		tn := tenantByName(q.Get("tenant"))
+		if tn == nil {
+			log.Printf("ERROR: export %d is for unknown tenant %s", id, q.Get("tenant"))
+			return httpInternalServerError
+		}
+		signed, err := awsPresign(tn, job.s3Key, &presignPolicy{
+			method: "GET",
+			expires: time.Until(*job.expiresAt),
+		})
+		if err != nil {
+			log.Printf("ERROR: could not sign export %d: %s", id, err)
+			return httpInternalServerError
+		}
+		resp.URL = signed.URL
+	}
+	return jsonResponse(resp)
+}
+
+/* resolves the job's query to archives, the same way the
+   synchronous endpoints would */
+func exportJobKeys(ctx context.Context, tn *tenant, q url.Values) ([]deviceLogKey, error) {
+	if isMeetingExport(q) {
+		mop, fail := readMeetingLogsOperation(ctx, q)
+		if fail != nil {
+			return nil, fmt.Errorf("could not resolve meeting instance")
+		}
+		return getMeetingLogKeys(ctx, tn, &mop)
+	}
+	glo, fail := readGetLogsOperation(ctx, q)
+	if fail != nil {
+		return nil, fmt.Errorf("could not resolve log range")
+	}
+	keys, err := getLogKeys(ctx, tn, glo)
+	if err != nil {
+		return nil, err
+	}
+	dks := unlabeledLogKeys(tn, keys)
+	for i := range dks {
+		dks[i].device = glo.token
+	}
+	return dks, nil
+}
+
+/* whose logs the zip holds, so an erasure can find it; logs
+   posted to /v1/logs by a device nobody knows have no owner */
+func exportDevices(q url.Values, keys []deviceLogKey) []string {
+	if !isMeetingExport(q) {
+		if q.Get("token") == "" {
+			return nil
+		}
+		return []string{ q.Get("token") }
+	}
+	var devices []string
+	seen := map[string]bool{ "inbound": true }
+	for _, dk := range keys {
+		if !seen[dk.device] {
+			seen[dk.device] = true
+			devices = append(devices, dk.device)
+		}
+	}
+	return devices
+}
+
+func runExportJob(serverCtx context.Context, job *exportJob) {
+	ctx, cancel := context.WithTimeout(serverCtx, MaxExportDurationInMinutes * time.Minute)
+	defer cancel()
+	log.Printf("INFO: running export job %d", job.id)
+	err := func() error {
+		q, err := url.ParseQuery(job.params)
+		if err != nil {
+			return err
+		}
+		report := &streamReport{}
+		queryBoolItem(q, "skip_bad", &report.skipBad, &err)
+		if err != nil {
+			return err
+		}
+		tn := tenantByName(q.Get("tenant"))
+		if tn == nil {
+			return fmt.Errorf("unknown tenant %s", q.Get("tenant"))
+		}
+		/* a policy that has gone away since the job was queued
+		   must not turn into no redaction at all */
+		policy := q.Get("redaction")
+		if _, ok := redactionPolicies[policy]; !ok {
+			return fmt.Errorf("unknown redaction policy %q", policy)
+		}
+		report.redactor = newRedactor(policy)
+		keys, err := exportJobKeys(ctx, tn, q)
+		if err != nil {
+			return err
+		}
+		devices := strings.Join(exportDevices(q, keys), " ")
+		job.devices = &devices
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(getLogsArchive(ctx, pw, keys, report))
+		}()
+		key := fmt.Sprintf("exports/%d.zip", job.id)
+		_, err = awsUpload(ctx, tn, key, pr, &awsObjectOptions{ contentType: "application/zip" })
+		pr.CloseWithError(err)
+		if err != nil {
+			return err
+		}
+		job.s3Key = key
+		job.archives = report.delivered
+		if len(report.skipped) > 0 {
+			job.skipped = report.skippedJSON()
+		}
+		return nil
+	}()
+	if serverCtx.Err() != nil {
+		/* left Running; another server requeues it once stale */
+		log.Printf("WARN: export job %d interrupted by shutdown", job.id)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: export job %d failed: %s", job.id, err)
+		job.state = "Failed"
+		job.message = oneLine(err.Error())
+	} else {
+		log.Printf("INFO: export job %d done: %d archives", job.id, job.archives)
+		job.state = "Done"
+		expiresAt := time.Now().UTC().Add(ExportExpiryInHours * time.Hour)
+		job.expiresAt = &expiresAt
+	}
+	/* the job's own context may have timed out, which is
+	   exactly the outcome we need to record */
+	if err := dbFinishExportJob(serverCtx, job); err != nil {
+		log.Printf("ERROR: could not record export job %d: %s", job.id, err)
+		return
+	}
+	if job.state == "Done" {
+		eraseExportIfErased(serverCtx, job)
+	}
+}
+
+/* deletes the zips of expired jobs */
+func deleteExpiredExports(ctx context.Context) {
+	jobs, err := dbExpiredExportObjects(ctx, ExportCleanupBatch)
+	if err != nil {
+		log.Printf("ERROR: could not read expired exports: %s", err)
+		return
+	}
+	for _, job := range jobs {
+		q, _ := url.ParseQuery(job.params)
+		tn := tenantByName(q.Get("tenant"))
+		if tn == nil {
+			log.Printf("ERROR: export %d is for unknown tenant %s", job.id, q.Get("tenant"))
+			continue
+		}
+		failed, err := awsDeleteObjects(ctx, tn, []string{ job.s3Key })
+		if err == nil && failed[job.s3Key] != "" {
+			err = fmt.Errorf("%s", failed[job.s3Key])
+		}
+		if err == nil {
+			err = dbClearExportObject(ctx, job.id)
+		}
+		if err != nil {
+			log.Printf("ERROR: could not delete expired export %d: %s", job.id, err)
+			continue
+		}
+		log.Printf("INFO: deleted expired export %d", job.id)
+	}
+}
+
+/* runs queued jobs one at a time until ctx is done */
+func runExportWorker(ctx context.Context) {
+	ticker := time.NewTicker(ExportPollIntervalInSeconds * time.Second)
+	defer ticker.Stop()
+	for {
+		if n, err := dbRequeueStaleExportJobs(ctx, ExportStaleAfterInMinutes * time.Minute); err != nil {
+			log.Printf("ERROR: could not requeue stale export jobs: %s", err)
+		} else if n > 0 {
+			log.Printf("WARN: requeued %d stale export jobs", n)
+		}
+		if n, err := dbExpireExportJobs(ctx); err != nil {
+			log.Printf("ERROR: could not expire export jobs: %s", err)
+		} else if n > 0 {
+			log.Printf("INFO: expired %d export jobs", n)
+		}
+		deleteExpiredExports(ctx)
+		for ctx.Err() == nil {
+			job, err := dbClaimExportJob(ctx)
+			if err != nil {
+				log.Printf("ERROR: could not claim export job: %s", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			runExportJob(ctx, job)
+		}
+		select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-exportWake:
+		}
+	}
+}
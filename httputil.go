@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"net"
 	"net/url"
 	"net/http"
+	"os"
 	"time"
 	"strconv"
+	"strings"
 	"log"
 )
 
@@ -39,6 +42,18 @@ func queryInt64Item(values url.Values, name string, pint *int64, perr *error) {
 	*pint, *perr = strconv.ParseInt(value, 10, 64)
 }
 
+func queryBoolItem(values url.Values, name string, pbool *bool, perr *error) {
+	if *perr != nil {
+		return
+	}
+	var value string
+	queryStringItem(values, name, &value)
+	if value == "" {
+		return
+	}
+	*pbool, *perr = strconv.ParseBool(value)
+}
+
 func httpBadRequest(w http.ResponseWriter) {
 	http.Error(w, "Bad Request", 400)
 }
@@ -51,6 +66,14 @@ func httpForbidden(w http.ResponseWriter) {
 	http.Error(w, "Forbidden", 403)
 }
 
+func httpNotFound(w http.ResponseWriter) {
+	http.Error(w, "Not Found", 404)
+}
+
+func httpTooManyRequests(w http.ResponseWriter) {
+	http.Error(w, "Too Many Requests", 429)
+}
+
 func httpOk(w http.ResponseWriter) {
 }
 
@@ -67,3 +90,51 @@ func jsonResponse(resp interface{}) func(w http.ResponseWriter) {
 		}
 	}
 }
+
+/* TRUSTED_PROXIES is a comma separated list of the addresses or
+   CIDR ranges of our gateway and load balancers. Headers that only
+   they are supposed to set are ignored from anyone else. */
+var trustedProxies []*net.IPNet
+
+func initTrustedProxies() {
+	for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			log.Fatalf("bad TRUSTED_PROXIES entry: %s", err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+}
+
+/* the address of whoever opened the connection */
+func peerAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func fromTrustedProxy(req *http.Request) bool {
+	ip := net.ParseIP(peerAddress(req))
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
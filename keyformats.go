@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+/* Layouts of the log object keys we know how to read. Each layout
+   is a regexp with named groups:
+
+     ts        required, parsed with timeLayout
+     device    device id, download token or client name
+     meeting   optional meeting id
+     instance  optional meeting instance id
+
+   fileStart is the time layout of the first part of the file name,
+   used to work out where listing can start; leave it empty if the
+   file name does not sort by time.
+
+   Layouts are tried in registration order, so register the more
+   specific ones first. */
+type keyLayout struct {
+	name       string
+	scope      string
+	re         *regexp.Regexp
+	timeLayout string
+	fileStart  string
+}
+
+var keyLayouts []*keyLayout
+
+func registerKeyLayout(layout *keyLayout) {
+	if layout.re.SubexpIndex("ts") < 0 {
+		panic(fmt.Sprintf("key layout %s has no ts group", layout.name))
+	}
+	keyLayouts = append(keyLayouts, layout)
+}
+
+const (
+	fuzeTimeLayout = "2006-01-02-15-04-05"
+	fuzeFileStart = "Fuze-2006-01-02-15-04-05"
+	dayDirLayout = "/2006/01/02/"
+)
+
+func init() {
+	/* Fuze-<ts>-<meeting>-<instance>.zip, written by clients that
+	   know which meeting the log belongs to */
+	registerKeyLayout(&keyLayout{
+		name: "device-meeting",
+		re: regexp.MustCompile(`^(?P<device>[^/]+)/\d{4}/\d\d/\d\d/Fuze-(?P<ts>\d{4}-\d\d-\d\d-\d\d-\d\d-\d\d)-(?P<meeting>\d+)-(?P<instance>\d+)\.zip$`),
+		timeLayout: fuzeTimeLayout,
+		fileStart: fuzeFileStart,
+	})
+	registerKeyLayout(&keyLayout{
+		name: "device",
+		re: regexp.MustCompile(`^(?P<device>[^/]+)/\d{4}/\d\d/\d\d/Fuze-(?P<ts>\d{4}-\d\d-\d\d-\d\d-\d\d-\d\d)(?:\.winstaller)?\.zip$`),
+		timeLayout: fuzeTimeLayout,
+		fileStart: fuzeFileStart,
+	})
+	registerKeyLayout(&keyLayout{
+		name: "download",
+		scope: "download",
+		re: regexp.MustCompile(`^download/(?P<device>[^/]+)/\d{4}/\d\d/\d\d/Fuze-(?P<ts>\d{4}-\d\d-\d\d-\d\d-\d\d-\d\d)(?:\.winstaller)?\.zip$`),
+		timeLayout: fuzeTimeLayout,
+		fileStart: fuzeFileStart,
+	})
+	registerKeyLayout(&keyLayout{
+		name: "unauthenticated",
+		scope: "unauthenticated",
+		re: regexp.MustCompile(`^unauthenticated/(?P<device>[^/]+)/\d{4}/\d\d/\d\d/Fuze-(?P<ts>\d{4}-\d\d-\d\d-\d\d-\d\d-\d\d)(?:\.winstaller)?\.zip$`),
+		timeLayout: fuzeTimeLayout,
+		fileStart: fuzeFileStart,
+	})
+	/* what keyParseRE used to accept, for anything that slips
+	   past the layouts above */
+	registerKeyLayout(&keyLayout{
+		name: "legacy",
+		re: regexp.MustCompile(`/Fuze-(?P<ts>\d{4}-\d\d-\d\d-\d\d-\d\d-\d\d)\.zip$`),
+		timeLayout: fuzeTimeLayout,
+		fileStart: fuzeFileStart,
+	})
+}
+
+func (layout *keyLayout) parse(key string) (*parsedKey, bool) {
+	m := layout.re.FindStringSubmatch(key)
+	if m == nil {
+		return nil, false
+	}
+	group := func (name string) string {
+		if i := layout.re.SubexpIndex(name); i >= 0 {
+			return m[i]
+		}
+		return ""
+	}
+	timestamp, err := time.Parse(layout.timeLayout, group("ts"))
+	if err != nil {
+		log.Printf("WARN: could not parse timestamp %s in %s", group("ts"), key)
+		return nil, true
+	}
+	return &parsedKey{
+		key: key,
+		layout: layout.name,
+		scope: layout.scope,
+		device: group("device"),
+		timestamp: timestamp,
+		meeting: group("meeting"),
+		instance: group("instance"),
+	}, true
+}
+
+func parseKey(key string) *parsedKey {
+	for _, layout := range keyLayouts {
+		if pk, matched := layout.parse(key); matched {
+			return pk
+		}
+	}
+	log.Printf("WARN: key %s did not match any key layout.", key)
+	return nil
+}
+
+/* the earliest key, among all layouts, that could hold logs
+   written at t under scanDir */
+func keyLayoutsStartAfter(scanDir string, t time.Time) string {
+	dayDir := scanDir + t.Format(dayDirLayout)
+	startAfter := ""
+	for _, layout := range keyLayouts {
+		candidate := dayDir
+		if layout.fileStart != "" {
+			candidate += t.Format(layout.fileStart)
+		}
+		if startAfter == "" || candidate < startAfter {
+			startAfter = candidate
+		}
+	}
+	return startAfter
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* merge mode: instead of copying zip entries one after another we
+   parse the timestamp at the start of each line and emit a single
+   time-ordered stream across every entry of every archive.
+
+   Lines without a timestamp (stack traces, wrapped json, ...) belong
+   to the record above them. Timestamps without an offset are read
+   in the zone from the stored log header, or UTC if there is none. */
+
+var lineTimeRE = regexp.MustCompile(`^\[?(\d\d\d\d-\d\d-\d\d)[ T](\d\d:\d\d:\d\d(?:[.,]\d{1,9})?)(Z|[+-]\d\d:?\d\d)?`)
+var tzOffsetRE = regexp.MustCompile(`^(?:UTC|GMT)?([+-])(\d\d?)(?::?(\d\d))?$`)
+
+func parseLineTime(line []byte, loc *time.Location) (time.Time, bool) {
+	m := lineTimeRE.FindSubmatch(line)
+	if m == nil {
+		return time.Time{}, false
+	}
+	value := string(m[1]) + " " + strings.Replace(string(m[2]), ",", ".", 1)
+	zone := string(m[3])
+	var t time.Time
+	var err error
+	switch {
+		case zone == "":
+			t, err = time.ParseInLocation("2006-01-02 15:04:05", value, loc)
+		case zone == "Z":
+			t, err = time.ParseInLocation("2006-01-02 15:04:05", value, time.UTC)
+		default:
+			if len(zone) == 5 {
+				zone = zone[:3] + ":" + zone[3:]
+			}
+			t, err = time.Parse("2006-01-02 15:04:05-07:00", value + zone)
+	}
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+/* the tz value is whatever the client put in the query string of
+   its upload, so we accept zone names as well as offsets */
+func parseTimeZone(tz string) *time.Location {
+	if tz == "" {
+		return time.UTC
+	}
+	if m := tzOffsetRE.FindStringSubmatch(tz); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		offset := hours * 3600 + minutes * 60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(tz, offset)
+	}
+	if loc, err := time.LoadLocation(tz); err == nil {
+		return loc
+	}
+	log.Printf("WARN: unrecognized time zone %q, using UTC", tz)
+	return time.UTC
+}
+
+/* reads the "log 1" preamble written by queueLog, if present,
+   and returns the zone from its header */
+func readStoredLogZone(br *bufio.Reader) (*time.Location, error) {
+	header, err := readStoredLogHeader(br)
+	if err != nil || header == nil {
+		return time.UTC, err
+	}
+	return parseTimeZone(header.TimeZone), nil
+}
+
+/* nil, and nothing read, if there is no preamble */
+func readStoredLogHeader(br *bufio.Reader) (*storedLogHeader, error) {
+	peek, _ := br.Peek(len(fileHeader) + 1)
+	if string(peek) != fileHeader + newline {
+		return nil, nil
+	}
+	br.Discard(len(peek))
+	sizeLine, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("truncated log header: %s", err)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(sizeLine))
+	if err != nil || size <= 0 {
+		return nil, fmt.Errorf("bad log header size %q", sizeLine)
+	}
+	hbytes := make([]byte, size)
+	if _, err := io.ReadFull(br, hbytes); err != nil {
+		return nil, fmt.Errorf("truncated log header: %s", err)
+	}
+	header := &storedLogHeader{}
+	if err := json.Unmarshal(hbytes, header); err != nil {
+		return nil, fmt.Errorf("bad log header: %s", err)
+	}
+	return header, nil
+}
+
+type logRecord struct {
+	timestamp time.Time
+	text      []byte
+}
+
+/* one zip entry, read a record at a time */
+type recordSource struct {
+	seq     int
+	key     string
+	label   string
+	closer  io.Closer
+	br      *bufio.Reader
+	loc     *time.Location
+	last    time.Time
+	pending []byte
+	current logRecord
+	done    bool
+}
+
+func newRecordSource(seq int, key string, label string, rc io.ReadCloser, start time.Time) (*recordSource, error) {
+	rs := &recordSource{
+		seq: seq,
+		key: key,
+		label: label,
+		closer: rc,
+		br: bufio.NewReader(rc),
+		last: start,
+	}
+	loc, err := readStoredLogZone(rs.br)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	rs.loc = loc
+	return rs, nil
+}
+
+func (rs *recordSource) readLine() ([]byte, error) {
+	if rs.pending != nil {
+		line := rs.pending
+		rs.pending = nil
+		return line, nil
+	}
+	line, err := rs.br.ReadBytes('\n')
+	if len(line) > 0 {
+		if line[len(line) - 1] != '\n' {
+			line = append(line, '\n')
+		}
+		return line, nil
+	}
+	return nil, err
+}
+
+/* advances to the next record; false at end of entry */
+func (rs *recordSource) next() (bool, error) {
+	line, err := rs.readLine()
+	if line == nil {
+		rs.done = true
+		rs.closer.Close()
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	if t, ok := parseLineTime(line, rs.loc); ok {
+		rs.last = t
+	}
+	rs.current = logRecord{ timestamp: rs.last, text: line }
+	for {
+		line, err = rs.readLine()
+		if line == nil {
+			if err != nil && err != io.EOF {
+				return false, err
+			}
+			return true, nil
+		}
+		if _, ok := parseLineTime(line, rs.loc); ok {
+			rs.pending = line
+			return true, nil
+		}
+		rs.current.text = append(rs.current.text, line...)
+	}
+}
+
+func (rs *recordSource) close() {
+	if !rs.done {
+		rs.done = true
+		rs.closer.Close()
+	}
+}
+
+type recordHeap []*recordSource
+
+func (h recordHeap) Len() int { return len(h) }
+func (h recordHeap) Less(i, j int) bool {
+	if h[i].current.timestamp.Equal(h[j].current.timestamp) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].current.timestamp.Before(h[j].current.timestamp)
+}
+func (h recordHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x interface{}) { *h = append(*h, x.(*recordSource)) }
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n - 1]
+	*h = old[:n - 1]
+	return x
+}
+
+func writeRecord(w io.Writer, label string, text []byte) error {
+	if label == "" {
+		_, err := w.Write(text)
+		return err
+	}
+	prefix := []byte("[" + label + "] ")
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if _, err := w.Write(prefix); err != nil {
+			return err
+		}
+		if _, err := w.Write(text[:end]); err != nil {
+			return err
+		}
+		text = text[end:]
+	}
+	return nil
+}
+
+/* opens every entry of one archive and reads its first record */
+func openRecordSources(ctx context.Context, dk deviceLogKey, seq *int) ([]*recordSource, error) {
+	entries, err := openLogArchive(ctx, dk.tenant, dk.key)
+	if err != nil {
+		return nil, err
+	}
+	var sources []*recordSource
+	fail := func (err error) ([]*recordSource, error) {
+		for _, rs := range sources {
+			rs.close()
+		}
+		return nil, fmt.Errorf("could not read zipentry %s: %w", dk.key, err)
+	}
+	for _, f := range entries {
+		rc, err := f.open()
+		if err != nil {
+			return fail(err)
+		}
+		rs, err := newRecordSource(*seq, dk.key, dk.device, rc, dk.timestamp)
+		*seq++
+		if err != nil {
+			return fail(err)
+		}
+		ok, err := rs.next()
+		if err != nil {
+			return fail(err)
+		}
+		if ok {
+			sources = append(sources, rs)
+		}
+	}
+	return sources, nil
+}
+
+/* keys must be ordered by archive start time. An archive is only
+   downloaded once every record still waiting in the merge is at or
+   after its start, which keeps roughly one window of overlapping
+   archives in memory rather than the whole range. */
+func getMergedLogs(ctx context.Context, w io.Writer, keys []deviceLogKey, report *streamReport) error {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	h := &recordHeap{}
+	defer func() {
+		for _, rs := range *h {
+			rs.close()
+		}
+	}()
+	seq := 0
+	i := 0
+	for i < len(keys) || h.Len() > 0 {
+		for i < len(keys) && (h.Len() == 0 || !(*h)[0].current.timestamp.Before(keys[i].timestamp)) {
+			dk := keys[i]
+			i++
+			sources, err := openRecordSources(ctx, dk, &seq)
+			if err != nil {
+				if report.skip(ctx, dk.key, err, nil) {
+					continue
+				}
+				return err
+			}
+			for _, rs := range sources {
+				heap.Push(h, rs)
+			}
+			/* counted once it's open; a later failure shows
+			   up as an error or a skip. Merged output has no
+			   resume cursor, records from many archives are
+			   interleaved. */
+			report.count()
+		}
+		if h.Len() == 0 {
+			continue
+		}
+		rs := (*h)[0]
+		if err := writeRecord(bw, rs.label, rs.current.text); err != nil {
+			return err
+		}
+		ok, err := rs.next()
+		if err != nil {
+			err = fmt.Errorf("could not read zipentry %s: %w", rs.key, err)
+			if !report.skip(ctx, rs.key, err, nil) {
+				return err
+			}
+			rs.close()
+			ok = false
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
 	"io"
+	"io/ioutil"
+	"path"
 	"time"
 	"net/http"
+	"net/url"
 	"bytes"
-	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"fmt"
 	"archive/zip"
 	"log"
@@ -14,40 +22,34 @@ import (
 const (
 	MaxGetLogRangeInHours = 14
 	LogLookbackTimeInHours = 3
-	MaxDownloadRetries = 20
+	FollowPollIntervalInSeconds = 15
+	MaxFollowDurationInMinutes = 120
+	MaxParallelListings = 8
 )
 
 type getLogsOperation struct {
     token      string
+    scope      string
     meetingId  int64
     instanceId int64
     beginTime  time.Time
     endTime    time.Time
+    openEnded  bool
+    follow     bool
+    followFor  time.Duration
+    merge      bool
+    resumeAfter *streamCursor
 }
 
 type parsedKey struct {
-	key		  string
+	key       string
+	layout    string
+	scope     string
+	device    string
 	timestamp time.Time
-	meeting	  string
+	meeting   string
 	instance  string
 }
-var keyParseRE = regexp.MustCompile(`/Fuze-(\d\d\d\d-\d\d-\d\d-\d\d-\d\d-\d\d)\.zip$`)
-func parseKey(key string) *parsedKey {
-	m := keyParseRE.FindStringSubmatch(key)
-	if m == nil {
-		log.Printf("WARN: key %s did not match regex.", key)
-		return nil
-	}
-	timestamp, err := time.Parse("2006-01-02-15-04-05", m[1])
-	if err != nil {
-		log.Printf("WARN: could not parse timestamp %s", m[1])
-		return nil
-	}
-	return &parsedKey {
-		key: key,
-		timestamp: timestamp,
-	}
-}
 
 type state struct {
 	op        *getLogsOperation
@@ -61,6 +63,11 @@ func handleKey(key string, state *state) bool {
 		/* we skip keys we don't understand */
 		return true
 	}
+	if pk.instance != "" && state.op.instanceId != 0 &&
+	   pk.instance != strconv.FormatInt(state.op.instanceId, 10) {
+		/* tagged with some other meeting */
+		return true
+	}
 	if state.gathered == nil {
 		if pk.timestamp.After(state.op.beginTime) {
 			if state.prior != "" {
@@ -77,6 +84,24 @@ func handleKey(key string, state *state) bool {
 	return !pk.timestamp.After(state.op.endTime)
 }
 
+/* device logs live under the device id; logs uploaded with a
+   download token or by an unauthenticated client live under
+   download/ and unauthenticated/ respectively */
+func (op *getLogsOperation) scanDir() string {
+	if op.scope == "" {
+		return op.token
+	}
+	return op.scope + "/" + op.token
+}
+
+/* the device the logs belong to, if the token names one */
+func (op *getLogsOperation) device() string {
+	if op.scope == "" {
+		return op.token
+	}
+	return ""
+}
+
 /* it is tricky to retrieve logs between beginTime and endTime
    because the logs for an event at time T are usually in a file
    that started before T, and interesting logs sometimes wind
@@ -87,136 +112,423 @@ func handleKey(key string, state *state) bool {
   
    We then include every file up to and including
    the first file after endTime.
- */
 
-func getLogKeys(bucket string, op getLogsOperation) ([]string, error) {
+   Listing is confined to the day directories the range covers,
+   plus the day after endTime to find that first file after it,
+   and the days are listed in parallel. When the upload index has
+   keys for that range they are used instead of a listing. */
+
+func logDayPrefixes(scanDir string, from time.Time, to time.Time) []string {
+	var prefixes []string
+	last := to.AddDate(0, 0, 1).Format(dayDirLayout)
+	for day := from; day.Format(dayDirLayout) <= last; day = day.AddDate(0, 0, 1) {
+		prefixes = append(prefixes, scanDir + day.Format(dayDirLayout))
+	}
+	return prefixes
+}
+
+func listLogDays(ctx context.Context, tn *tenant, prefixes []string, startAfter string) ([][]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	listed := make([][]string, len(prefixes))
+	sem := make(chan struct{}, MaxParallelListings)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i, prefix := range prefixes {
+		wg.Add(1)
+		go func (i int, prefix string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			after := ""
+			if i == 0 {
+				after = startAfter
+			}
+			err := awsList(ctx, tn, prefix, after,
+				func (key string) bool {
+					listed[i] = append(listed[i], key)
+					return true
+				})
+			if err != nil {
+				/* no point finishing the other days */
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i, prefix)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return listed, nil
+}
+
+func getLogKeys(ctx context.Context, tn *tenant, op getLogsOperation) ([]string, error) {
 	log.Printf("INFO: using time range: %s - %s", op.beginTime.Format(time.RFC3339), op.endTime.Format(time.RFC3339))
 	state := state{ op: &op }
-	scanTime := op.beginTime.Add(-LogLookbackTimeInHours * time.Hour)
-	scanDir := op.token
-	startDay := scanTime.Format("/2006/01/02/")
-	startFile := scanTime.Format("Fuze-2006-01-02-15-04-05")
-	startAfter := scanDir + startDay + startFile
-	err := awsList(bucket, scanDir, startAfter, 
-		func (key string) bool {
-			return handleKey(key, &state)
-		})
-	if err != nil {
-		return nil, err
+	scanTime := op.beginTime.Add(-LogLookbackTimeInHours * time.Hour).UTC()
+	scanDir := op.scanDir()
+	var listed [][]string
+	if indexed, ok := indexedLogKeys(ctx, tn, scanDir, scanTime, op.endTime.UTC()); ok {
+		listed = [][]string{ indexed }
+	} else {
+		var err error
+		prefixes := logDayPrefixes(scanDir, scanTime, op.endTime.UTC())
+		listed, err = listLogDays(ctx, tn, prefixes, keyLayoutsStartAfter(scanDir, scanTime))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, keys := range listed {
+		for _, key := range keys {
+			if !handleKey(key, &state) {
+				return resumeLogKeys(state.gathered, op.resumeAfter), nil
+			}
+		}
+	}
+	return resumeLogKeys(state.gathered, op.resumeAfter), nil
+}
+
+/* drops the keys a previous response already delivered. Keys of one
+   scan directory sort by time, so if the cursor's key has since gone
+   we carry on from the first key after it. */
+func resumeLogKeys(keys []string, cursor *streamCursor) []string {
+	if cursor == nil {
+		return keys
+	}
+	for i, key := range keys {
+		if key < cursor.Key {
+			continue
+		}
+		if key == cursor.Key && cursor.Entries < 0 {
+			return keys[i + 1:]
+		}
+		return keys[i:]
 	}
-	return state.gathered, nil
+	return nil
 }
 
-func getLogs(w io.Writer, bucket string, keys []string) error {
-	errorCount := 0
+/* A truncated upload usually fails in zip.NewReader, before we have
+   written anything for it; an entry that fails half way through
+   leaves whatever was already copied in the stream. */
+func getLogs(ctx context.Context, w io.Writer, tn *tenant, keys []string, report *streamReport) error {
+	tw := &trackingWriter{ w: w }
 	for _, key := range keys {
-		if err := getSingleLog(w, bucket, key, &errorCount); err != nil {
+		resumeEntries := report.resumeEntries(key)
+		entries := 0
+		err := forEachLogEntry(ctx, tn, key,
+			func (name string, r io.Reader) error {
+				entries++
+				if entries <= resumeEntries {
+					return nil
+				}
+				if _, err := io.Copy(tw, r); err != nil {
+					return err
+				}
+				report.entryDone(key, entries)
+				return nil
+			})
+		if err != nil {
+			if report.skip(ctx, key, err, tw) {
+				continue
+			}
 			return err
 		}
+		report.done(key)
 	}
 	return nil
 }
 
-func retryDownload(bucket string, key string, perrorCount *int) (buff []byte, numBytes int64, err error) {
+/* follow mode: keep listing the device prefix after the last key
+   we streamed and send new archives as they show up, until the
+   client goes away or the follow duration runs out */
+func followLogs(ctx context.Context, w io.Writer, tn *tenant, op getLogsOperation, lastKey string, report *streamReport) error {
+	/* without the slash, following abc would pick up abcd too */
+	prefix := op.scanDir() + "/"
+	if !strings.HasPrefix(lastKey, prefix) {
+		lastKey = keyLayoutsStartAfter(op.scanDir(), op.beginTime)
+	}
+	flusher, _ := w.(http.Flusher)
+	deadline := time.NewTimer(op.followFor)
+	defer deadline.Stop()
+	ticker := time.NewTicker(FollowPollIntervalInSeconds * time.Second)
+	defer ticker.Stop()
 	for {
-		buff, numBytes, err = awsDownload(bucket, key)
-		if err == nil {
-			return
+		select {
+			case <-ctx.Done():
+				log.Printf("INFO: follow ended by client: %s", ctx.Err())
+				return nil
+			case <-deadline.C:
+				log.Printf("INFO: follow ended after %s", op.followFor)
+				return nil
+			case <-ticker.C:
 		}
-		*perrorCount++
-		log.Printf("ERROR: downloading %s: %s (try %d of %d)", key, err, *perrorCount, MaxDownloadRetries)
-		if *perrorCount == MaxDownloadRetries {
-			log.Printf("ERROR: giving up after %d retries", MaxDownloadRetries)
-			return
+		var keys []string
+		err := awsList(ctx, tn, prefix, lastKey,
+			func (key string) bool {
+				if parseKey(key) != nil {
+					keys = append(keys, key)
+				}
+				return true
+			})
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if op.merge {
+				err = getMergedLogs(ctx, w, unlabeledLogKeys(tn, keys), report)
+			} else {
+				err = getLogs(ctx, w, tn, keys, report)
+			}
+			if err != nil {
+				return err
+			}
+			lastKey = keys[len(keys) - 1]
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+/* merge input for a single device; getLogKeys only returns keys
+   that parse, in time order */
+func unlabeledLogKeys(tn *tenant, keys []string) []deviceLogKey {
+	var dks []deviceLogKey
+	for _, key := range keys {
+		if pk := parseKey(key); pk != nil {
+			dks = append(dks, deviceLogKey{ tenant: tn, key: key, timestamp: pk.timestamp })
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
+	return dks
 }
 
+type logEntryFunc func (name string, r io.Reader) error
 
-func getSingleLog(w io.Writer, bucket string, key string, perrorCount *int) error {
-	buff, numBytes, err := retryDownload(bucket, key, perrorCount)
+/* one file of an archive */
+type logEntry struct {
+	name string
+	open func () (io.ReadCloser, error)
+}
+
+/* a log posted to /v1/logs (see queueLog) is a single entry named
+   after its key, with the body decoded if it was sent compressed;
+   the "log 1" header stays in front, it has the zone merging needs */
+func storedLogEntries(key string, buff []byte) ([]logEntry, error) {
+	r := bytes.NewReader(buff)
+	br := bufio.NewReader(r)
+	header, err := readStoredLogHeader(br)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("could not read stored log %s: %w", key, err)
+	}
+	headerSize := len(buff) - r.Len() - br.Buffered()
+	return []logEntry{{
+		name: path.Base(key) + ".log",
+		open: func () (io.ReadCloser, error) {
+			body := bytes.NewReader(buff[headerSize:])
+			var r io.Reader = body
+			if header.Encoding == "gzip" {
+				gr, err := gzip.NewReader(body)
+				if err != nil {
+					return nil, err
+				}
+				r = gr
+			}
+			return ioutil.NopCloser(io.MultiReader(bytes.NewReader(buff[:headerSize]), r)), nil
+		},
+	}}, nil
+}
+
+/* the entries of a log archive, decrypted if it was stored with
+   envelope encryption; quarantined uploads are refused */
+func openLogArchive(ctx context.Context, tn *tenant, key string) ([]logEntry, error) {
+	if err := checkQuarantine(ctx, tn, key); err != nil {
+		return nil, err
+	}
+	buff, numBytes, err := awsDownload(ctx, tn, key)
+	if err != nil {
+		return nil, err
 	}
 	log.Printf("INFO: downloaded %s (%d bytes)", key, numBytes)
+	if isEnvelope(buff) {
+		buff, err = decryptEnvelope(ctx, tn, buff)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt %s: %w", key, err)
+		}
+		numBytes = int64(len(buff))
+	}
+	if bytes.HasPrefix(buff, []byte(fileHeader + newline)) {
+		return storedLogEntries(key, buff)
+	}
 	zr, err := zip.NewReader(bytes.NewReader(buff), numBytes)
-    if err != nil {
-		return fmt.Errorf("could not read zip: %s", key, err)
-    }
-    for _, f := range zr.File {
-        fr, err := f.Open()
-        if err != nil {
-			return fmt.Errorf("could not read zipentry: %s", key, err)
-        }
-        defer fr.Close()
-		_, err = io.Copy(w, fr)
+	if err != nil {
+		return nil, fmt.Errorf("could not read zip %s: %w", key, err)
+	}
+	entries := make([]logEntry, len(zr.File))
+	for i, f := range zr.File {
+		entries[i] = logEntry{ name: f.Name, open: f.Open }
+	}
+	return entries, nil
+}
+
+func forEachLogEntry(ctx context.Context, tn *tenant, key string, onEntry logEntryFunc) error {
+	entries, err := openLogArchive(ctx, tn, key)
+	if err != nil {
+		return err
+	}
+	for _, f := range entries {
+		fr, err := f.open()
 		if err != nil {
-			return fmt.Errorf("could not copy zipentry: %s", key, err)
+			return fmt.Errorf("could not read zipentry %s: %w", key, err)
 		}
-    }
+		err = onEntry(f.name, fr)
+		fr.Close()
+		if err != nil {
+			return fmt.Errorf("could not copy zipentry %s: %w", key, err)
+		}
+	}
 	return nil
 }
 
+func getSingleLog(ctx context.Context, w io.Writer, tn *tenant, key string) error {
+	return forEachLogEntry(ctx, tn, key,
+		func (name string, r io.Reader) error {
+			_, err := io.Copy(w, r)
+			return err
+		})
+}
+
 func authenticateGetLogs(w http.ResponseWriter, req *http.Request) bool {
 	return true
 }
 
-func logsGet(req *http.Request) func(http.ResponseWriter) {
-/*
-	if !authenticateGetLogs(w, req) {
-		return
-	}
- */
+/* reads which logs a request is for: the scan directory and the
+   time range, from the query or from the meeting instance. Shared by
+   GET /v1/logs and export jobs; fail is nil if the query is good. */
+func readGetLogsOperation(ctx context.Context, q url.Values) (glo getLogsOperation, fail func(http.ResponseWriter)) {
 	var err error
-	q := req.URL.Query()
-	glo := getLogsOperation{};
 	queryStringItem(q, "token", &glo.token)
+	if glo.token == "" {
+		queryStringItem(q, "download_token", &glo.token)
+		glo.scope = "download"
+	}
+	if glo.token == "" {
+		queryStringItem(q, "client", &glo.token)
+		glo.scope = "unauthenticated"
+	}
 	queryInt64Item(q, "meeting_id", &glo.meetingId, &err)
 	queryInt64Item(q, "instance_id", &glo.instanceId, &err)
 	queryRFC3339Item(q, "begin_time", &glo.beginTime, &err)
 	queryRFC3339Item(q, "end_time", &glo.endTime, &err)
+	queryBoolItem(q, "follow", &glo.follow, &err)
+	queryBoolItem(q, "merge", &glo.merge, &err)
+	var resumeAfter string
+	queryStringItem(q, "resume_after", &resumeAfter)
+	if err == nil && resumeAfter != "" {
+		glo.resumeAfter, err = decodeStreamCursor(resumeAfter)
+	}
+	var followMinutes int64
+	queryInt64Item(q, "follow_minutes", &followMinutes, &err)
 	if err != nil {
 		log.Printf("ERROR: malformed query: %s", err)
-		return httpBadRequest
+		return glo, httpBadRequest
 	}
 	if glo.token == "" {
 		log.Printf("ERROR: missing token")
-		return httpBadRequest
+		return glo, httpBadRequest
+	}
+	if glo.merge && glo.resumeAfter != nil {
+		log.Printf("ERROR: merged output cannot be resumed")
+		return glo, httpBadRequest
 	}
 	if glo.meetingId != 0 || glo.instanceId != 0 {
-		mi, err := dbGetMeetingInstanceInfo(req.Context(), glo.instanceId)
+		mi, err := dbGetMeetingInstanceInfo(ctx, glo.instanceId)
 		if err != nil {
 			log.Printf("ERROR: could not read start/end times for instance %d: %s", glo.instanceId, err)
-			return httpInternalServerError
+			return glo, httpInternalServerError
 		}
 		if mi == nil {
 			log.Printf("WARN: no meeting instance for id %d", glo.instanceId)
-			return httpBadRequest
+			return glo, httpBadRequest
 		}
 		glo.beginTime = mi.startedAt
 		glo.endTime = mi.endedAt
+		if mi.inProgress {
+			/* still running, so the range is "so far" */
+			glo.endTime = time.Now().UTC()
+			glo.openEnded = true
+		}
+	}
+	if glo.follow {
+		glo.followFor = MaxFollowDurationInMinutes * time.Minute
+		if followMinutes > 0 && followMinutes < MaxFollowDurationInMinutes {
+			glo.followFor = time.Duration(followMinutes) * time.Minute
+		}
+		if glo.endTime.IsZero() {
+			glo.endTime = time.Now().UTC()
+			glo.openEnded = true
+		}
 	}
 	zeroTime := time.Time{}
 	if glo.endTime == zeroTime ||
 	   int(glo.endTime.Sub(glo.beginTime).Hours()) > MaxGetLogRangeInHours {
 		log.Printf("ERROR: invalid time range: %s - %s", glo.beginTime, glo.endTime)
+		return glo, httpBadRequest
+	}
+	return glo, nil
+}
+
+func logsGet(req *http.Request) func(http.ResponseWriter) {
+/*
+	if !authenticateGetLogs(w, req) {
+		return
+	}
+ */
+	var err error
+	q := req.URL.Query()
+	glo, fail := readGetLogsOperation(req.Context(), q)
+	if fail != nil {
+		return fail
+	}
+	report := &streamReport{ resume: glo.resumeAfter, redactor: newRedactor(requestRedactionPolicy(req)) }
+	queryBoolItem(q, "skip_bad", &report.skipBad, &err)
+	var terminator bool
+	queryBoolItem(q, "terminator", &terminator, &err)
+	if err != nil {
+		log.Printf("ERROR: malformed query: %s", err)
 		return httpBadRequest
 	}
-	keys, err := getLogKeys("mbk-upload-bucket", glo)
+	tn, err := requestTenant(req.Context(), req, glo.device())
+	if err != nil {
+		log.Printf("ERROR: could not resolve tenant: %s", err)
+		return httpInternalServerError
+	}
+	keys, err := getLogKeys(req.Context(), tn, glo)
 	if err != nil {
 		log.Printf("ERROR: could not obtain log keys: %s", err)
 		return httpInternalServerError
 	}
 	return func(w http.ResponseWriter) {
-		w.Header().Add("Trailer", "X-Streaming-Error")
-		err = getLogs(w, "mbk-upload-bucket", keys)
-		if err != nil {
-			log.Printf("ERROR: trouble streaming result: %s", err)
-			w.Header().Set("X-Streaming-Error", "true")
+		if glo.openEnded {
+			w.Header().Set("X-Log-Range-Open", "true")
+			w.Header().Set("X-Log-Range-End", glo.endTime.Format(time.RFC3339))
+		}
+		ls := beginLogStream(w, req, "text/plain; charset=utf-8", terminator, report)
+		if glo.merge {
+			err = getMergedLogs(req.Context(), ls.out, unlabeledLogKeys(tn, keys), report)
 		} else {
-			log.Printf("INFO: success")
-			w.Header().Set("X-Streaming-Error", "false")
+			err = getLogs(req.Context(), ls.out, tn, keys, report)
+		}
+		if err == nil && glo.follow {
+			lastKey := ""
+			if len(keys) > 0 {
+				lastKey = keys[len(keys) - 1]
+			}
+			err = followLogs(req.Context(), ls.out, tn, glo, lastKey, report)
 		}
+		ls.finish(req.Context(), err)
 	}
 }
@@ -9,8 +9,11 @@ import (
 	"context"
 	"bytes"
 	"crypto/rand"
+	"strconv"
 	"strings"
 	"io"
+	"io/ioutil"
+	"os"
 )
 
 const (
@@ -20,9 +23,21 @@ const (
 )
 
 type storedLogHeader struct {
-	Token     string `json:"token"`
-	TimeZone  string `json:"tz"`
-	Encoding  string `json:"encoding"`
+	Token           string `json:"token"`
+	TimeZone        string `json:"tz"`
+	Encoding        string `json:"encoding"`
+	DeviceId        string `json:"device_id,omitempty"`
+	Client          string `json:"client,omitempty"`
+	MeetingInstance int64  `json:"meeting_instance,omitempty"`
+}
+
+/* the same metadata presigned uploads carry */
+func (header *storedLogHeader) metadata() map[string]string {
+	return uploadMetadata(&uploadURLRequest{
+		deviceId: header.DeviceId,
+		client: header.Client,
+		meetingInstance: strconv.FormatInt(header.MeetingInstance, 10),
+	})
 }
 
 func randomKey() (string, error) {
@@ -34,7 +49,38 @@ func randomKey() (string, error) {
     return fmt.Sprintf("/inbound/%s", hex.EncodeToString(randId)), nil
 }
 
-func queueLog(context context.Context, header *storedLogHeader, r io.Reader) (string, error) {
+/* the request body can only be read once, so it is copied where
+   awsUpload can rewind it for another try: memory up to
+   MaxInMemoryMultipartMB, a temporary file beyond that. Call done
+   once the upload is over. */
+func spoolBody(r io.Reader) (body io.ReadSeeker, done func(), err error) {
+	var buf bytes.Buffer
+	limit := int64(MaxInMemoryMultipartMB) << 20
+	if _, err := io.CopyN(&buf, r, limit + 1); err == io.EOF {
+		return bytes.NewReader(buf.Bytes()), func() {}, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	f, err := ioutil.TempFile("", "queued-log-")
+	if err != nil {
+		return nil, nil, err
+	}
+	done = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if _, err := io.Copy(f, io.MultiReader(&buf, r)); err != nil {
+		done()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		done()
+		return nil, nil, err
+	}
+	return f, done, nil
+}
+
+func queueLog(ctx context.Context, tn *tenant, header *storedLogHeader, r io.Reader) (string, error) {
 	hbytes, err := json.Marshal(header)
 	if err != nil {
 		return "", err
@@ -48,10 +94,27 @@ func queueLog(context context.Context, header *storedLogHeader, r io.Reader) (st
 	if err != nil {
 		return "", err
 	}
-	url, err := awsUpload("mbk-upload-bucket", key, mr)
+	var stored io.Reader = mr
+	/* see envelope.go for who can read these */
+	if tn.Envelope {
+		er := envelopeReader(ctx, tn, mr)
+		defer er.Close()
+		stored = er
+	}
+	body, done, err := spoolBody(stored)
 	if err != nil {
 		return "", err
 	}
+	defer done()
+	url, err := awsUpload(ctx, tn, key, body, &awsObjectOptions{ metadata: header.metadata() })
+	if err != nil {
+		return "", err
+	}
+	/* so the log can be found by device and meeting instance
+	   right away; the S3 event would get there eventually */
+	if err := indexUpload(ctx, tn, key, "logs_post"); err != nil {
+		log.Printf("WARN: could not index %s: %s", key, err)
+	}
 	return url, nil
 }
 
@@ -71,7 +134,8 @@ func logsV1Post(req *http.Request) func(http.ResponseWriter) {
 	} else if !ok {
 		return httpForbidden
 	}
-	return logsPost(token, req)
+	/* the v1 token is the device id */
+	return logsPost(token, token, req)
 }
 
 func logsV2Post(req *http.Request) func(http.ResponseWriter) {
@@ -82,10 +146,10 @@ func logsV2Post(req *http.Request) func(http.ResponseWriter) {
 	} else if !ok {
 		return httpForbidden
 	}
-	return logsPost(token, req)
+	return logsPost(token, "", req)
 }
 
-func logsPost(token string, req *http.Request) func(http.ResponseWriter) {
+func logsPost(token string, deviceId string, req *http.Request) func(http.ResponseWriter) {
     ct := req.Header.Get("Content-Type")
 	var r io.Reader
 	switch {
@@ -100,7 +164,7 @@ func logsPost(token string, req *http.Request) func(http.ResponseWriter) {
 			log.Printf("INFO: multipart content-type: %s", ct)
 			file, _, err := req.FormFile("request")
 			if err == http.ErrMissingFile {
-				log.Printf("INFO: missing file", ct)
+				log.Printf("INFO: missing file: %s", ct)
 				return httpBadRequest
 			} else if err != nil {
 				return httpInternalServerError
@@ -112,11 +176,25 @@ func logsPost(token string, req *http.Request) func(http.ResponseWriter) {
 			return httpBadRequest
 	}
 
-	url, err := queueLog(req.Context(), &storedLogHeader{
+	header := &storedLogHeader{
 		Token: token,
 		TimeZone: req.URL.Query().Get("tz"),
 		Encoding: req.Header.Get("Content-Encoding"),
-	}, r)
+		DeviceId: deviceId,
+		Client: req.URL.Query().Get("client"),
+	}
+	var err error
+	queryInt64Item(req.URL.Query(), "meeting_instance", &header.MeetingInstance, &err)
+	if err != nil || header.MeetingInstance < 0 {
+		log.Printf("INFO: bad meeting_instance: %s", req.URL.Query().Get("meeting_instance"))
+		return httpBadRequest
+	}
+	tn, err := requestTenant(req.Context(), req, deviceId)
+	if err != nil {
+		log.Printf("ERROR: could not resolve tenant: %s", err)
+		return httpInternalServerError
+	}
+	url, err := queueLog(req.Context(), tn, header, r)
 	if err != nil {
 		log.Printf("ERROR: could not process request: %s", err)
 		return httpInternalServerError
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/* Protocol for streamed log responses.
+
+   The header goes out before the first byte of the body and
+   declares these trailers, which are filled in once streaming ends:
+
+     X-Streaming-Error          "true" or "false"
+     X-Streaming-Error-Code     empty on success, see streamErrorCode
+     X-Streaming-Error-Message  one line, for humans
+     X-Streamed-Keys            number of archives delivered
+     X-Streamed-Bytes           body bytes delivered
+     X-Skipped-Keys             json list of skipped archives
+     X-Resume-Cursor            pass as resume_after to pick up
+                                where this response stopped
+     X-Redactions               json count of redactions per rule,
+                                see redact.go
+
+   HTTP/1.0 clients never get trailers, and some proxies drop them,
+   so text responses to HTTP/1.0 requests, or with terminator=true,
+   also end with a line carrying the same information:
+
+     #feedmicro-end status=ok code= keys=12 bytes=3456 skipped=0 redacted=0 cursor=... message=""
+
+   Archive responses don't get the line; a zip cut short has no
+   central directory, which every client notices anyway. */
+
+const (
+	streamTerminatorPrefix = "#feedmicro-end"
+	MaxStreamErrorMessageLength = 200
+)
+
+var streamTrailers = []string{
+	"X-Streaming-Error",
+	"X-Streaming-Error-Code",
+	"X-Streaming-Error-Message",
+	"X-Streamed-Keys",
+	"X-Streamed-Bytes",
+	"X-Skipped-Keys",
+	"X-Resume-Cursor",
+	"X-Redactions",
+}
+
+/* where a response got to: the last archive we started and how many
+   of its entries went out in full, or -1 once all of them did */
+type streamCursor struct {
+	Key     string `json:"k"`
+	Entries int    `json:"e"`
+}
+
+func (c *streamCursor) encode() string {
+	if c.Key == "" {
+		return ""
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeStreamCursor(value string) (*streamCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("bad cursor: %s", err)
+	}
+	c := &streamCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.Key == "" || c.Entries < -1 {
+		return nil, fmt.Errorf("bad cursor %q", value)
+	}
+	return c, nil
+}
+
+/* archives we could not read, when the caller asked us to carry
+   on without them (skip_bad=true) */
+type skippedKey struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+type streamReport struct {
+	skipBad   bool
+	skipped   []skippedKey
+	delivered int
+	cursor    streamCursor
+	resume    *streamCursor
+	redactor  *redactor
+}
+
+/* decides whether a failure on key can be skipped, and records it
+   if so. Failures writing to the client, or a request that has gone
+   away, can never be skipped. */
+func (sr *streamReport) skip(ctx context.Context, key string, err error, tw *trackingWriter) bool {
+	if sr == nil || !sr.skipBad || ctx.Err() != nil || (tw != nil && tw.err != nil) {
+		return false
+	}
+	log.Printf("WARN: skipping %s: %s", key, err)
+	sr.skipped = append(sr.skipped, skippedKey{ Key: key, Reason: err.Error() })
+	return true
+}
+
+func (sr *streamReport) count() {
+	if sr != nil {
+		sr.delivered++
+	}
+}
+
+func (sr *streamReport) done(key string) {
+	if sr != nil {
+		sr.delivered++
+		sr.cursor = streamCursor{ Key: key, Entries: -1 }
+	}
+}
+
+func (sr *streamReport) entryDone(key string, entries int) {
+	if sr != nil {
+		sr.cursor = streamCursor{ Key: key, Entries: entries }
+	}
+}
+
+/* how many leading entries of key the resumed-from response already
+   delivered; only the first archive of a resumed response has any */
+func (sr *streamReport) resumeEntries(key string) int {
+	if sr == nil || sr.resume == nil || sr.resume.Key != key {
+		return 0
+	}
+	entries := sr.resume.Entries
+	sr.resume = nil
+	return entries
+}
+
+/* records an entry of key that was left out; unlike skip this is
+   not up to skip_bad, as the entry can never be written */
+func (sr *streamReport) skipEntry(key string, name string, reason string) {
+	if sr == nil {
+		return
+	}
+	sr.skipped = append(sr.skipped, skippedKey{ Key: key, Reason: fmt.Sprintf("%s: %q", reason, name) })
+}
+
+func (sr *streamReport) skippedJSON() string {
+	if sr == nil || len(sr.skipped) == 0 {
+		return "[]"
+	}
+	b, err := json.Marshal(sr.skipped)
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+/* remembers the first error from the underlying writer so we can
+   tell a broken archive from a broken connection */
+type trackingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (tw *trackingWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	if err != nil && tw.err == nil {
+		tw.err = err
+	}
+	return n, err
+}
+
+/* counts body bytes, and passes Flush through for follow mode */
+type countingWriter struct {
+	w     http.ResponseWriter
+	bytes int64
+	err   error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.bytes += int64(n)
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+func (cw *countingWriter) Flush() {
+	if flusher, ok := cw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/* out is body, through the report's redactor if it has one;
+   archives are redacted entry by entry instead */
+type logStream struct {
+	w      http.ResponseWriter
+	body   *countingWriter
+	out    io.Writer
+	report *streamReport
+	inband bool
+}
+
+/* declares the trailers and sends the header; everything after
+   this writes to ls.out */
+func beginLogStream(w http.ResponseWriter, req *http.Request, contentType string, terminator bool, report *streamReport) *logStream {
+	ls := &logStream{
+		w: w,
+		body: &countingWriter{ w: w },
+		report: report,
+	}
+	ls.out = ls.body
+	if report != nil && contentType != "application/zip" {
+		ls.out = report.redactor.writer(ls.body)
+	}
+	ls.inband = contentType != "application/zip" && (terminator || !req.ProtoAtLeast(1, 1))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Trailer", strings.Join(streamTrailers, ", "))
+	w.WriteHeader(http.StatusOK)
+	return ls
+}
+
+func streamErrorCode(ctx context.Context, err error, body *countingWriter) string {
+	var aerr awserr.Error
+	switch {
+		case err == nil:
+			return ""
+		case body.err != nil:
+			return "client_write"
+		case ctx.Err() == context.DeadlineExceeded:
+			return "timeout"
+		case ctx.Err() != nil:
+			return "canceled"
+		case errors.Is(err, zip.ErrFormat), errors.Is(err, zip.ErrChecksum), errors.Is(err, zip.ErrAlgorithm):
+			return "corrupt_archive"
+		case errors.Is(err, errQuarantined):
+			return "quarantined"
+		case errors.As(err, &aerr) && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"):
+			return "missing_archive"
+		case errors.As(err, &aerr) && aerr.Code() == "AccessDenied":
+			return "access_denied"
+		case errors.As(err, &aerr):
+			return "storage"
+		default:
+			return "internal"
+	}
+}
+
+func oneLine(s string) string {
+	s = strings.Map(func (r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+	if len(s) > MaxStreamErrorMessageLength {
+		s = s[:MaxStreamErrorMessageLength]
+	}
+	return s
+}
+
+/* fills in the trailers and, if asked for, the terminator line */
+func (ls *logStream) finish(ctx context.Context, err error) {
+	if ferr := flushRedaction(ls.out); err == nil {
+		err = ferr
+	}
+	code := streamErrorCode(ctx, err, ls.body)
+	status := "ok"
+	message := ""
+	if err != nil {
+		status = "error"
+		message = oneLine(err.Error())
+		log.Printf("ERROR: trouble streaming result (%s): %s", code, err)
+	} else {
+		log.Printf("INFO: success")
+	}
+	bodyBytes := ls.body.bytes
+	delivered := 0
+	skipped := 0
+	cursor := ""
+	var rd *redactor
+	if ls.report != nil {
+		rd = ls.report.redactor
+		delivered = ls.report.delivered
+		skipped = len(ls.report.skipped)
+		cursor = ls.report.cursor.encode()
+	}
+	if ls.inband && ls.body.err == nil {
+		fmt.Fprintf(ls.body, "\n%s status=%s code=%s keys=%d bytes=%d skipped=%d redacted=%d cursor=%s message=%q\n",
+			streamTerminatorPrefix, status, code, delivered, bodyBytes, skipped, rd.total(), cursor, message)
+	}
+	h := ls.w.Header()
+	h.Set("X-Streaming-Error", strconv.FormatBool(err != nil))
+	h.Set("X-Streaming-Error-Code", code)
+	h.Set("X-Streaming-Error-Message", message)
+	h.Set("X-Streamed-Keys", strconv.Itoa(delivered))
+	h.Set("X-Streamed-Bytes", strconv.FormatInt(bodyBytes, 10))
+	h.Set("X-Skipped-Keys", ls.report.skippedJSON())
+	h.Set("X-Resume-Cursor", cursor)
+	h.Set("X-Redactions", rd.countsJSON())
+}
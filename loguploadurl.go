@@ -6,7 +6,9 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"mime"
 	"net/http"
+	"time"
 )
 
 
@@ -40,20 +42,61 @@ type uploadURLRequest struct {
 	client          string
 	downloadToken   string
 	meetingInstance string
+	maxSize         int64
+	contentLength   int64
+	post            bool
+
+	/* decided by the server, not the query */
+	tenant          *tenant
+	expires         time.Duration
+	quarantine      bool
+}
+
+type uploadKeyFunc func(uur uploadURLRequest) string
+
+/* pattern builds the key for an upload; prefix is the part of it
+   that belongs to the caller, which multipart requests are checked
+   against */
+type uploadLayout struct {
+	name    string
+	pattern uploadKeyFunc
+	prefix  uploadKeyFunc
+}
+
+func datedFileName(uur uploadURLRequest) string {
+	return fmt.Sprintf("%s/%s/%s/%s", uur.year, uur.month, uur.day, uur.fileName)
+}
+
+func normalPrefix(uur uploadURLRequest) string {
+	return fmt.Sprintf("%s/", uur.deviceId)
 }
 
 func normalPattern(uur uploadURLRequest) string {
-	return fmt.Sprintf("%s/%s/%s/%s/%s", uur.deviceId, uur.year, uur.month, uur.day, uur.fileName)
+	return normalPrefix(uur) + datedFileName(uur)
+}
+
+func downloadPrefix(uur uploadURLRequest) string {
+	return fmt.Sprintf("download/%s/", uur.downloadToken)
 }
 
 func downloadPattern(uur uploadURLRequest) string {
-	return fmt.Sprintf("download/%s/%s/%s/%s/%s", uur.downloadToken, uur.year, uur.month, uur.day, uur.fileName)
+	return downloadPrefix(uur) + datedFileName(uur)
+}
+
+func unauthenticatedPrefix(uur uploadURLRequest) string {
+	return fmt.Sprintf("unauthenticated/%s/", uur.client)
 }
 
 func unauthenticatedPattern(uur uploadURLRequest) string {
-	return fmt.Sprintf("unauthenticated/%s/%s/%s/%s/%s", uur.client, uur.year, uur.month, uur.day, uur.fileName)
+	return unauthenticatedPrefix(uur) + datedFileName(uur)
 }
 
+var (
+	normalLayout = uploadLayout{ "normal", normalPattern, normalPrefix }
+	downloadLayout = uploadLayout{ "download", downloadPattern, downloadPrefix }
+	unauthenticatedLayout = uploadLayout{ "unauthenticated", unauthenticatedPattern, unauthenticatedPrefix }
+)
+
 /* invalid/non-existing meeting IDs are ignored */
 func readMeetingDate(ctx context.Context, uur *uploadURLRequest) error {
 	id, err := strconv.ParseInt(uur.meetingInstance, 10, 64)
@@ -76,17 +119,153 @@ func readMeetingDate(ctx context.Context, uur *uploadURLRequest) error {
 	return nil
 }
 
+/* headers are the ones the client must send with the PUT exactly as
+   given; with max_size there is no PUT, the client POSTs post_fields
+   as a multipart form to post_url instead */
 type structuredResponse struct {
-	SignedRequest string  `json:"signed_request"`
-	Message       string  `json:"message"`
-	Code          float64 `json:"code"`
-	ContentType   string  `json:"content_type"`
+	SignedRequest string            `json:"signed_request"`
+	Message       string            `json:"message"`
+	Code          float64           `json:"code"`
+	ContentType   string            `json:"content_type"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	PostURL       string            `json:"post_url,omitempty"`
+	PostFields    map[string]string `json:"post_fields,omitempty"`
+	Deprecation   string            `json:"deprecation,omitempty"`
 }
 
-func logUploadURLGet(req *http.Request) func(w http.ResponseWriter) {
+const (
+	MaxUploadSizeInBytes = 2 << 30
+)
+
+var allowedUploadContentTypes = map[string]bool{
+	"application/zip": true,
+	"application/x-zip-compressed": true,
+	"application/gzip": true,
+	"application/x-gzip": true,
+	"application/octet-stream": true,
+	"text/plain": true,
+}
+
+/* a content_type the client names is checked against the list and
+   signed into the URL; clients that name none get a URL that binds
+   no type, as they always have, since signing one in would break
+   their uploads with SignatureDoesNotMatch */
+func checkUploadContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		log.Printf("WARN malformed content type: %s", contentType)
+		return false
+	}
+	if !allowedUploadContentTypes[mediaType] {
+		log.Printf("WARN content type not allowed: %s", contentType)
+		return false
+	}
+	return true
+}
+
+/* set on uploads the scanner has to clear before they are read */
+const QuarantineMetadataField = "x-amz-meta-quarantine"
+
+/* object metadata naming who uploaded and for which meeting; the
+   upload index reads them back when the key does not say. Only
+   POST and multipart uploads carry them: on a presigned PUT they
+   would be signed headers, which existing clients don't send, so
+   for those the server records them itself (upload_attributions). */
+const (
+	DeviceMetadataKey = "device-id"
+	ClientMetadataKey = "client"
+	MeetingInstanceMetadataKey = "meeting-instance"
+)
+
+/* values go into signed headers, so anything outside the key
+   charset is left out rather than risk a signature mismatch */
+func uploadMetadata(uur *uploadURLRequest) map[string]string {
+	metadata := map[string]string{}
+	if keySegmentRE.MatchString(uur.deviceId) {
+		metadata[DeviceMetadataKey] = uur.deviceId
+	}
+	if keySegmentRE.MatchString(uur.client) {
+		metadata[ClientMetadataKey] = uur.client
+	}
+	if id, err := strconv.ParseInt(uur.meetingInstance, 10, 64); err == nil && id > 0 {
+		metadata[MeetingInstanceMetadataKey] = strconv.FormatInt(id, 10)
+	}
+	return metadata
+}
+
+func signUpload(ctx context.Context, s3key string, uur *uploadURLRequest) (*structuredResponse, error) {
+	resp := &structuredResponse{
+		Message:     "",
+		Code:        200,
+		ContentType: uur.contentType,
+	}
+	expires := uur.expires
+	if expires == 0 {
+		expires = DefaultUploadURLExpiry
+	}
+	metadata := uploadMetadata(uur)
+	if uur.maxSize > 0 || uur.post {
+		if uur.maxSize == 0 {
+			uur.maxSize = MaxUploadSizeInBytes
+		}
+		policy := &postPolicy{
+			expires: expires,
+			contentType: uur.contentType,
+			minSize: 1,
+			maxSize: uur.maxSize,
+			fields: map[string]string{},
+		}
+		for name, value := range metadata {
+			policy.fields["x-amz-meta-" + name] = value
+		}
+		if uur.quarantine {
+			policy.fields[QuarantineMetadataField] = "pending"
+		}
+		post, err := awsPresignPost(uur.tenant, s3key, policy)
+		if err != nil {
+			return nil, err
+		}
+		resp.PostURL = post.URL
+		resp.PostFields = post.Fields
+		return resp, nil
+	}
+	signed, err := awsPresign(uur.tenant, s3key, &presignPolicy{
+		method: "PUT",
+		expires: expires,
+		contentType: uur.contentType,
+		contentLength: uur.contentLength,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata) > 0 {
+		/* the upload works without it, the index just knows less */
+		if err := dbRecordUploadAttribution(ctx, uur.tenant, s3key, metadata); err != nil {
+			log.Printf("WARN: could not record attribution of %s: %s", s3key, err)
+		}
+	}
+	resp.SignedRequest = signed.URL
+	if uur.quarantine {
+		resp.Deprecation = UnauthenticatedPutDeprecation
+	}
+	if len(signed.Headers) > 0 {
+		resp.Headers = map[string]string{}
+		for name, values := range signed.Headers {
+			resp.Headers[name] = strings.Join(values, ",")
+		}
+	}
+	return resp, nil
+}
+
+/* reads and authenticates an upload request; shared by
+   /v1/log_upload_url and the multipart endpoints. fail is nil
+   if the caller may upload under layout.prefix(uur). */
+func readUploadURLRequest(req *http.Request) (uur uploadURLRequest, layout uploadLayout, fail func(http.ResponseWriter)) {
 	ctx := req.Context()
 	q := req.URL.Query()
-	uur := uploadURLRequest{}
 	queryStringItem(q, "token", &uur.token)
 	queryStringItem(q, "file_name", &uur.fileName)
 	queryStringItem(q, "content_type", &uur.contentType)
@@ -99,25 +278,39 @@ func logUploadURLGet(req *http.Request) func(w http.ResponseWriter) {
 	queryStringItem(q, "meeting_instance", &uur.meetingInstance)
 
 	var err error
+	queryInt64Item(q, "max_size", &uur.maxSize, &err)
+	if err != nil || uur.maxSize < 0 || uur.maxSize > MaxUploadSizeInBytes {
+		log.Printf("WARN bad max_size: %d %v", uur.maxSize, err)
+		return uur, layout, httpBadRequest
+	}
+	queryInt64Item(q, "content_length", &uur.contentLength, &err)
+	queryBoolItem(q, "post", &uur.post, &err)
+	if err != nil || uur.contentLength < 0 || uur.contentLength > MaxUploadSizeInBytes {
+		log.Printf("WARN bad content_length or post: %d %v", uur.contentLength, err)
+		return uur, layout, httpBadRequest
+	}
+	if !checkUploadContentType(uur.contentType) {
+		return uur, layout, httpBadRequest
+	}
 	ok := true
-	patternFunc := unauthenticatedPattern
+	layout = unauthenticatedLayout
 
 	/* authentication rule and pattern selection */
 	if len(uur.token) > 0 {
-		patternFunc = normalPattern
+		layout = normalLayout
 		ok = checkToken(uur.token, req)
 	} else if len(uur.deviceId) > 0 {
-		patternFunc = normalPattern
+		layout = normalLayout
 		ok, err = checkDeviceId(ctx, uur.deviceId)
 	} else if len(uur.downloadToken) > 0 {
-		patternFunc = downloadPattern
+		layout = downloadLayout
 		ok, err = checkDownloadToken(ctx, uur.downloadToken)
 	}
 	if err != nil {
-		return httpInternalServerError
+		return uur, layout, httpInternalServerError
 	}
 	if !ok {
-		return httpForbidden
+		return uur, layout, httpForbidden
 	}
 
 	/* special handling of parameters */
@@ -131,24 +324,46 @@ func logUploadURLGet(req *http.Request) func(w http.ResponseWriter) {
 		if len(uur.token) > 0 || len(uur.deviceId) > 0 {
 			err = readMeetingDate(ctx, &uur)
 			if err != nil {
-				return httpInternalServerError
+				return uur, layout, httpInternalServerError
 			}
 		}
 	}
 	if len(uur.token) > 0 && uur.deviceId == "ngbrowser" {
 		uur.deviceId = uur.token
 	}
+	if err := checkUploadKey(&uur, layout, time.Now()); err != nil {
+		log.Printf("WARN rejected upload key: %s", err)
+		return uur, layout, httpBadRequest
+	}
+	if layout.name == unauthenticatedLayout.name {
+		if fail := checkUnauthenticatedUpload(req, &uur); fail != nil {
+			return uur, layout, fail
+		}
+	}
+	device := ""
+	if layout.name == normalLayout.name {
+		device = uur.deviceId
+	}
+	uur.tenant, err = requestTenant(ctx, req, device)
+	if err != nil {
+		log.Printf("ERROR: could not resolve tenant: %s", err)
+		return uur, layout, httpInternalServerError
+	}
+	return uur, layout, nil
+}
 
-	s3key := patternFunc(uur)
-	signedUrl, err := awsMakeSignedUrl("mbk-upload-bucket", s3key)
+func logUploadURLGet(req *http.Request) func(w http.ResponseWriter) {
+	uur, layout, fail := readUploadURLRequest(req)
+	if fail != nil {
+		return fail
+	}
+
+	s3key := layout.pattern(uur)
+	resp, err := signUpload(req.Context(), s3key, &uur)
 	if err != nil {
+		log.Printf("ERROR: could not sign %s: %s", s3key, err)
 		return httpInternalServerError
 	}
 
-	return jsonResponse(&structuredResponse{
-		SignedRequest: signedUrl,
-		Message:       "",
-		Code:          200,
-		ContentType:   uur.contentType,
-	})
+	return jsonResponse(resp)
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* one archive in a multi-device retrieval; devices of different
+   organizations may keep their logs with different tenants */
+type deviceLogKey struct {
+	tenant    *tenant
+	device    string
+	key       string
+	timestamp time.Time
+}
+
+type getMeetingLogsOperation struct {
+	instanceId int64
+	format     string
+	merge      bool
+	beginTime  time.Time
+	endTime    time.Time
+	openEnded  bool
+	devices    []string
+}
+
+/* collects the keys of every participating device for the
+   instance's window, plus any upload indexed under the instance,
+   ordered by archive start time. Each device is looked up in the
+   tenant of its organization, or tn if that has none. */
+func getMeetingLogKeys(ctx context.Context, tn *tenant, mop *getMeetingLogsOperation) ([]deviceLogKey, error) {
+	var all []deviceLogKey
+	seen := map[string]bool{}
+	tenants := []*tenant{ tn }
+	for _, device := range mop.devices {
+		dtn, err := deviceTenant(ctx, device, tn)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := getLogKeys(ctx, dtn, getLogsOperation{
+			token: device,
+			instanceId: mop.instanceId,
+			beginTime: mop.beginTime,
+			endTime: mop.endTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			pk := parseKey(key)
+			if pk == nil {
+				continue
+			}
+			all = append(all, deviceLogKey{ tenant: dtn, device: device, key: key, timestamp: pk.timestamp })
+			seen[dtn.Name + ":" + key] = true
+		}
+		known := false
+		for _, t := range tenants {
+			known = known || t == dtn
+		}
+		if !known {
+			tenants = append(tenants, dtn)
+		}
+	}
+	/* uploads tagged with the instance belong to it whenever they
+	   were written, and whether or not the device is a participant */
+	for _, t := range tenants {
+		tagged, err := meetingInstanceUploads(ctx, t, mop.instanceId)
+		if err != nil {
+			log.Printf("WARN: could not read uploads for meeting instance %d: %s", mop.instanceId, err)
+		}
+		for _, upload := range tagged {
+			if seen[t.Name + ":" + upload.key] {
+				continue
+			}
+			/* logs posted to /v1/logs have no time in their key,
+			   they are placed by when they came in */
+			timestamp := upload.uploadedAt
+			device := upload.device
+			if !strings.HasPrefix(upload.key, "/inbound/") {
+				pk := parseKey(upload.key)
+				if pk == nil {
+					continue
+				}
+				timestamp = pk.timestamp
+				if device == "" {
+					device = pk.device
+				}
+			}
+			if device == "" {
+				device = "inbound"
+			}
+			all = append(all, deviceLogKey{ tenant: t, device: device, key: upload.key, timestamp: timestamp })
+		}
+	}
+	sort.SliceStable(all, func (i, j int) bool {
+		return all[i].timestamp.Before(all[j].timestamp)
+	})
+	return all, nil
+}
+
+/* whether name stays inside the directory it is extracted to,
+   with either kind of slash */
+func safeEntryName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+/* archive format: one zip entry per log file, named
+   <device>/<archive>/<entry>, and a final skipped.json manifest
+   when archives were skipped */
+func getLogsArchive(ctx context.Context, w io.Writer, keys []deviceLogKey, report *streamReport) error {
+	tw := &trackingWriter{ w: w }
+	zw := zip.NewWriter(tw)
+	for _, dk := range keys {
+		archive := strings.TrimSuffix(path.Base(dk.key), ".zip")
+		err := forEachLogEntry(ctx, dk.tenant, dk.key,
+			func (name string, r io.Reader) error {
+				/* name is whatever the uploader put in its zip */
+				if !safeEntryName(name) {
+					log.Printf("WARN: unsafe entry name %q in %s", name, dk.key)
+					report.skipEntry(dk.key, name, "unsafe entry name")
+					return nil
+				}
+				ew, err := zw.Create(path.Join(dk.device, archive, name))
+				if err != nil {
+					return err
+				}
+				var rd *redactor
+				if report != nil {
+					rd = report.redactor
+				}
+				rw := rd.writer(ew)
+				if _, err := io.Copy(rw, r); err != nil {
+					return err
+				}
+				return flushRedaction(rw)
+			})
+		if err != nil {
+			if report.skip(ctx, dk.key, err, tw) {
+				continue
+			}
+			return err
+		}
+		report.count()
+	}
+	if report != nil && len(report.skipped) > 0 {
+		mw, err := zw.Create("skipped.json")
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(mw, report.skippedJSON()); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+/* prefixes every line written through it with a device label */
+type labelWriter struct {
+	w     *bufio.Writer
+	label string
+	bol   bool
+}
+
+func newLabelWriter(w *bufio.Writer, label string) *labelWriter {
+	return &labelWriter{ w: w, label: "[" + label + "] ", bol: true }
+}
+
+func (lw *labelWriter) Write(p []byte) (int, error) {
+	for i, c := range p {
+		if lw.bol {
+			if _, err := lw.w.WriteString(lw.label); err != nil {
+				return i, err
+			}
+			lw.bol = false
+		}
+		if err := lw.w.WriteByte(c); err != nil {
+			return i, err
+		}
+		lw.bol = c == '\n'
+	}
+	return len(p), nil
+}
+
+/* stream format: archives from all devices interleaved by their
+   start time, every line labeled with its device; with merge=true
+   the interleaving is per record instead, see getMergedLogs */
+func getMeetingLogsStream(ctx context.Context, w io.Writer, keys []deviceLogKey, report *streamReport) error {
+	tw := &trackingWriter{ w: w }
+	bw := bufio.NewWriter(tw)
+	for _, dk := range keys {
+		lw := newLabelWriter(bw, dk.device)
+		if err := getSingleLog(ctx, lw, dk.tenant, dk.key); err != nil {
+			bw.Flush()
+			if report.skip(ctx, dk.key, err, tw) {
+				continue
+			}
+			return err
+		}
+		report.count()
+		if !lw.bol {
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+/* reads the instance and its devices; shared by GET
+   /v1/meeting_logs and export jobs, fail is nil if all is well */
+func readMeetingLogsOperation(ctx context.Context, q url.Values) (mop getMeetingLogsOperation, fail func(http.ResponseWriter)) {
+	var err error
+	mop.format = "archive"
+	queryInt64Item(q, "instance_id", &mop.instanceId, &err)
+	queryStringItem(q, "format", &mop.format)
+	queryBoolItem(q, "merge", &mop.merge, &err)
+	if err != nil {
+		log.Printf("ERROR: malformed query: %s", err)
+		return mop, httpBadRequest
+	}
+	if mop.instanceId == 0 || (mop.format != "archive" && mop.format != "stream") {
+		log.Printf("ERROR: missing instance_id or bad format %q", mop.format)
+		return mop, httpBadRequest
+	}
+	mi, err := dbGetMeetingInstanceInfo(ctx, mop.instanceId)
+	if err != nil {
+		log.Printf("ERROR: could not read start/end times for instance %d: %s", mop.instanceId, err)
+		return mop, httpInternalServerError
+	}
+	if mi == nil {
+		log.Printf("WARN: no meeting instance for id %d", mop.instanceId)
+		return mop, httpBadRequest
+	}
+	mop.beginTime = mi.startedAt
+	mop.endTime = mi.endedAt
+	if mi.inProgress {
+		mop.endTime = time.Now().UTC()
+		mop.openEnded = true
+	}
+	if int(mop.endTime.Sub(mop.beginTime).Hours()) > MaxGetLogRangeInHours {
+		log.Printf("ERROR: invalid time range: %s - %s", mop.beginTime, mop.endTime)
+		return mop, httpBadRequest
+	}
+	mop.devices, err = dbGetMeetingInstanceDevices(ctx, mop.instanceId)
+	if err != nil {
+		log.Printf("ERROR: could not read devices for instance %d: %s", mop.instanceId, err)
+		return mop, httpInternalServerError
+	}
+	return mop, nil
+}
+
+func meetingLogsGet(req *http.Request) func(http.ResponseWriter) {
+	var err error
+	ctx := req.Context()
+	q := req.URL.Query()
+	mop, fail := readMeetingLogsOperation(ctx, q)
+	if fail != nil {
+		return fail
+	}
+	report := &streamReport{ redactor: newRedactor(requestRedactionPolicy(req)) }
+	queryBoolItem(q, "skip_bad", &report.skipBad, &err)
+	var terminator bool
+	queryBoolItem(q, "terminator", &terminator, &err)
+	if err != nil {
+		log.Printf("ERROR: malformed query: %s", err)
+		return httpBadRequest
+	}
+	/* participants may belong to several organizations, the
+	   host only decides for those whose organization doesn't */
+	tn, err := requestTenant(ctx, req, "")
+	if err != nil {
+		log.Printf("ERROR: could not resolve tenant: %s", err)
+		return httpInternalServerError
+	}
+	keys, err := getMeetingLogKeys(ctx, tn, &mop)
+	if err != nil {
+		log.Printf("ERROR: could not obtain log keys: %s", err)
+		return httpInternalServerError
+	}
+	log.Printf("INFO: instance %d: %d devices, %d archives", mop.instanceId, len(mop.devices), len(keys))
+	return func(w http.ResponseWriter) {
+		if mop.openEnded {
+			w.Header().Set("X-Log-Range-Open", "true")
+			w.Header().Set("X-Log-Range-End", mop.endTime.Format(time.RFC3339))
+		}
+		w.Header().Set("X-Log-Devices", strings.Join(mop.devices, ","))
+		if mop.format == "archive" {
+			ls := beginLogStream(w, req, "application/zip", false, report)
+			err = getLogsArchive(ctx, ls.out, keys, report)
+			ls.finish(ctx, err)
+		} else {
+			ls := beginLogStream(w, req, "text/plain; charset=utf-8", terminator, report)
+			if mop.merge {
+				err = getMergedLogs(ctx, ls.out, keys, report)
+			} else {
+				err = getMeetingLogsStream(ctx, ls.out, keys, report)
+			}
+			ls.finish(ctx, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/* Multipart uploads for bundles too big (or networks too flaky) for
+   a single presigned PUT. Every call takes the same query as
+   /v1/log_upload_url and is authenticated the same way:
+
+     POST .../initiate                         -> {key, upload_id}
+     GET  .../part?key=&upload_id=&part_number= -> presigned PUT for one part
+     POST .../complete?key=&upload_id=          body {"parts":[{part_number, etag}]}
+     POST .../abort?key=&upload_id=
+
+   key must lie under the prefix the caller's query names. That is
+   not a check that the upload is the caller's: with token auth the
+   device_id is not tied to the token, so a caller can name any
+   device. What keeps one caller from finishing or aborting
+   another's upload is the upload_id, which S3 makes unguessable and
+   only the initiating caller is given. Unauthenticated callers only
+   get size-capped POSTs, so they cannot use multipart at all. */
+
+const (
+	MaxMultipartParts = 10000
+	MaxCompleteBodyInBytes = 1 << 20
+)
+
+type multipartInitiateResponse struct {
+	Key         string `json:"key"`
+	UploadId    string `json:"upload_id"`
+	ContentType string `json:"content_type"`
+	MaxParts    int    `json:"max_parts"`
+}
+
+type multipartPartResponse struct {
+	SignedRequest string            `json:"signed_request"`
+	PartNumber    int64             `json:"part_number"`
+	Headers       map[string]string `json:"headers,omitempty"`
+}
+
+type multipartCompleteRequest struct {
+	Parts []awsCompletedPart `json:"parts"`
+}
+
+type multipartCompleteResponse struct {
+	Key      string `json:"key"`
+	Location string `json:"location"`
+}
+
+/* authenticates like readUploadURLRequest and checks that key lies
+   under the prefix the query names, see the top of this file */
+func readMultipartUploadRequest(req *http.Request) (uur uploadURLRequest, layout uploadLayout, fail func(http.ResponseWriter)) {
+	/* checked before readUploadURLRequest, which would count
+	   the refusal against the caller's unauthenticated quota */
+	q := req.URL.Query()
+	if q.Get("token") == "" && q.Get("device_id") == "" && q.Get("download_token") == "" {
+		log.Printf("WARN: unauthenticated multipart upload refused")
+		return uur, layout, httpForbidden
+	}
+	return readUploadURLRequest(req)
+}
+
+func readMultipartRequest(req *http.Request) (tn *tenant, key string, uploadId string, fail func(http.ResponseWriter)) {
+	uur, layout, fail := readMultipartUploadRequest(req)
+	if fail != nil {
+		return nil, "", "", fail
+	}
+	q := req.URL.Query()
+	queryStringItem(q, "key", &key)
+	queryStringItem(q, "upload_id", &uploadId)
+	if key == "" || uploadId == "" {
+		log.Printf("WARN: multipart request without key or upload_id")
+		return nil, "", "", httpBadRequest
+	}
+	if !strings.HasPrefix(key, layout.prefix(uur)) {
+		log.Printf("WARN: multipart key %s outside of %s", key, layout.prefix(uur))
+		return nil, "", "", httpForbidden
+	}
+	return uur.tenant, key, uploadId, nil
+}
+
+func multipartInitiatePost(req *http.Request) func(http.ResponseWriter) {
+	uur, layout, fail := readMultipartUploadRequest(req)
+	if fail != nil {
+		return fail
+	}
+	s3key := layout.pattern(uur)
+	uploadId, err := awsCreateMultipartUpload(req.Context(), uur.tenant, s3key, &awsObjectOptions{
+		contentType: uur.contentType,
+		metadata: uploadMetadata(&uur),
+	})
+	if err != nil {
+		log.Printf("ERROR: could not initiate multipart upload %s: %s", s3key, err)
+		return httpInternalServerError
+	}
+	log.Printf("INFO: initiated multipart upload %s", s3key)
+	return jsonResponse(&multipartInitiateResponse{
+		Key: s3key,
+		UploadId: uploadId,
+		ContentType: uur.contentType,
+		MaxParts: MaxMultipartParts,
+	})
+}
+
+func multipartPartGet(req *http.Request) func(http.ResponseWriter) {
+	tn, key, uploadId, fail := readMultipartRequest(req)
+	if fail != nil {
+		return fail
+	}
+	var err error
+	var partNumber int64
+	queryInt64Item(req.URL.Query(), "part_number", &partNumber, &err)
+	if err != nil || partNumber < 1 || partNumber > MaxMultipartParts {
+		log.Printf("WARN: bad part_number: %d %v", partNumber, err)
+		return httpBadRequest
+	}
+	signed, err := awsPresign(tn, key, &presignPolicy{
+		method: "PUT",
+		uploadId: uploadId,
+		partNumber: partNumber,
+		expires: DefaultUploadURLExpiry,
+	})
+	if err != nil {
+		log.Printf("ERROR: could not sign part %d of %s: %s", partNumber, key, err)
+		return httpInternalServerError
+	}
+	resp := &multipartPartResponse{
+		SignedRequest: signed.URL,
+		PartNumber: partNumber,
+	}
+	if len(signed.Headers) > 0 {
+		resp.Headers = map[string]string{}
+		for name, values := range signed.Headers {
+			resp.Headers[name] = strings.Join(values, ",")
+		}
+	}
+	return jsonResponse(resp)
+}
+
+func multipartCompletePost(req *http.Request) func(http.ResponseWriter) {
+	tn, key, uploadId, fail := readMultipartRequest(req)
+	if fail != nil {
+		return fail
+	}
+	var body multipartCompleteRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, MaxCompleteBodyInBytes)).Decode(&body); err != nil {
+		log.Printf("WARN: bad multipart complete body for %s: %s", key, err)
+		return httpBadRequest
+	}
+	if len(body.Parts) == 0 || len(body.Parts) > MaxMultipartParts {
+		log.Printf("WARN: multipart complete for %s with %d parts", key, len(body.Parts))
+		return httpBadRequest
+	}
+	/* S3 wants them in ascending order, clients retrying parts
+	   in parallel rarely report them that way */
+	sort.Slice(body.Parts, func(i, j int) bool {
+		return body.Parts[i].PartNumber < body.Parts[j].PartNumber
+	})
+	for i, part := range body.Parts {
+		if part.PartNumber < 1 || part.PartNumber > MaxMultipartParts || part.ETag == "" ||
+			(i > 0 && part.PartNumber == body.Parts[i - 1].PartNumber) {
+			log.Printf("WARN: bad part %d in multipart complete for %s", part.PartNumber, key)
+			return httpBadRequest
+		}
+	}
+	location, err := awsCompleteMultipartUpload(req.Context(), tn, key, uploadId, body.Parts)
+	if err != nil {
+		log.Printf("ERROR: could not complete multipart upload %s: %s", key, err)
+		return httpInternalServerError
+	}
+	log.Printf("INFO: completed multipart upload %s: %d parts", key, len(body.Parts))
+	if err := indexUpload(req.Context(), tn, key, "multipart"); err != nil {
+		/* the S3 event will catch up with it */
+		log.Printf("WARN: could not index %s: %s", key, err)
+	}
+	return jsonResponse(&multipartCompleteResponse{ Key: key, Location: location })
+}
+
+func multipartAbortPost(req *http.Request) func(http.ResponseWriter) {
+	tn, key, uploadId, fail := readMultipartRequest(req)
+	if fail != nil {
+		return fail
+	}
+	if err := awsAbortMultipartUpload(req.Context(), tn, key, uploadId); err != nil {
+		log.Printf("ERROR: could not abort multipart upload %s: %s", key, err)
+		return httpInternalServerError
+	}
+	log.Printf("INFO: aborted multipart upload %s", key)
+	return jsonResponse(&multipartCompleteResponse{ Key: key })
+}
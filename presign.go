@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	DefaultUploadURLExpiry = 24 * time.Hour
+	MaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+/* What a presigned URL is good for. Everything that is set is
+   signed, so the client has to send exactly that value (returned
+   in presignedRequest.Headers) or S3 rejects the request. Uploads
+   without sse get the tenant's encryption.
+
+   A presigned PUT can only pin an exact Content-Length; for a
+   range use a presigned POST, see awsPresignPost. Metadata on a PUT
+   is signed as x-amz-meta-* headers, not hoisted into the URL.
+
+   With uploadId set, a PUT is for part partNumber of that
+   multipart upload; content type, metadata and encryption were
+   fixed when the upload was created. */
+type presignPolicy struct {
+	method        string
+	uploadId      string
+	partNumber    int64
+	expires       time.Duration
+	contentType   string
+	metadata      map[string]string
+	contentLength int64
+	checksumMD5   string
+	sse           string
+	sseKMSKeyId   string
+}
+
+type presignedRequest struct {
+	URL     string
+	Method  string
+	Headers http.Header
+}
+
+func (p *presignPolicy) expiry() (time.Duration, error) {
+	if p.expires <= 0 || p.expires > MaxPresignExpiry {
+		return 0, fmt.Errorf("presign expiry %s out of range", p.expires)
+	}
+	return p.expires, nil
+}
+
+func awsPresign(tn *tenant, key string, policy *presignPolicy) (*presignedRequest, error) {
+	expires, err := policy.expiry()
+	if err != nil {
+		return nil, err
+	}
+	var req *request.Request
+	switch policy.method {
+		case "GET":
+			req, _ = tn.clients().svc.GetObjectRequest(&s3.GetObjectInput{
+				Bucket: aws.String(tn.Bucket),
+				Key: aws.String(tn.key(key)),
+			})
+		case "PUT":
+			if policy.uploadId != "" {
+				input := &s3.UploadPartInput{
+					Bucket: aws.String(tn.Bucket),
+					Key: aws.String(tn.key(key)),
+					UploadId: aws.String(policy.uploadId),
+					PartNumber: aws.Int64(policy.partNumber),
+				}
+				if policy.contentLength > 0 {
+					input.ContentLength = aws.Int64(policy.contentLength)
+				}
+				if policy.checksumMD5 != "" {
+					input.ContentMD5 = aws.String(policy.checksumMD5)
+				}
+				req, _ = tn.clients().svc.UploadPartRequest(input)
+				break
+			}
+			input := &s3.PutObjectInput{
+				Bucket: aws.String(tn.Bucket),
+				Key: aws.String(tn.key(key)),
+			}
+			if policy.contentType != "" {
+				input.ContentType = aws.String(policy.contentType)
+			}
+			if len(policy.metadata) > 0 {
+				input.Metadata = aws.StringMap(policy.metadata)
+			}
+			if policy.contentLength > 0 {
+				input.ContentLength = aws.Int64(policy.contentLength)
+			}
+			if policy.checksumMD5 != "" {
+				input.ContentMD5 = aws.String(policy.checksumMD5)
+			}
+			sse, keyId := policy.sse, policy.sseKMSKeyId
+			if sse == "" {
+				sse, keyId = tn.sse()
+			}
+			if sse != "" {
+				input.ServerSideEncryption = aws.String(sse)
+			}
+			if keyId != "" {
+				input.SSEKMSKeyId = aws.String(keyId)
+			}
+			req, _ = tn.clients().svc.PutObjectRequest(input)
+		default:
+			return nil, fmt.Errorf("cannot presign %s requests", policy.method)
+	}
+	if req == nil {
+		return nil, fmt.Errorf("could not prepare request for signing %s:%s", tn.Name, key)
+	}
+	url, headers, err := req.PresignRequest(expires)
+	if err != nil {
+		return nil, err
+	}
+	/* Host is implied by the url */
+	headers.Del("Host")
+	return &presignedRequest{ URL: url, Method: policy.method, Headers: headers }, nil
+}
+
+/* Conditions for a browser-style POST upload. Unlike a PUT this
+   can bound the size; fields are extra form fields that must be
+   sent with exactly these values (x-amz-meta-*, tagging, ...).
+   As with PUTs, no sse means the tenant's encryption. */
+type postPolicy struct {
+	expires     time.Duration
+	contentType string
+	minSize     int64
+	maxSize     int64
+	sse         string
+	sseKMSKeyId string
+	fields      map[string]string
+}
+
+type presignedPost struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/* the signature of a base64 encoded POST policy */
+func postPolicySignature(secretAccessKey string, date string, region string, encoded string) string {
+	signingKey := hmacSHA256([]byte("AWS4" + secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(signingKey, encoded))
+}
+
+/* the SDK has no helper for POST policies, so this is the
+   signature version 4 recipe from the S3 docs */
+func awsPresignPost(tn *tenant, key string, policy *postPolicy) (*presignedPost, error) {
+	if policy.expires <= 0 || policy.expires > MaxPresignExpiry {
+		return nil, fmt.Errorf("presign expiry %s out of range", policy.expires)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+	region := tn.clients().region
+	if region == "" {
+		return nil, fmt.Errorf("no region configured for signing")
+	}
+	return signPostPolicy(tn, key, policy, creds, region, time.Now())
+}
+
+/* awsPresignPost with the credentials, region and clock given */
+func signPostPolicy(tn *tenant, key string, policy *postPolicy, creds credentials.Value, region string, now time.Time) (*presignedPost, error) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	credential := fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKeyID, date, region)
+
+	fields := map[string]string{
+		"key": tn.key(key),
+		"x-amz-algorithm": "AWS4-HMAC-SHA256",
+		"x-amz-credential": credential,
+		"x-amz-date": now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	if policy.contentType != "" {
+		fields["Content-Type"] = policy.contentType
+	}
+	sse, keyId := policy.sse, policy.sseKMSKeyId
+	if sse == "" {
+		sse, keyId = tn.sse()
+	}
+	if sse != "" {
+		fields["x-amz-server-side-encryption"] = sse
+	}
+	if keyId != "" {
+		fields["x-amz-server-side-encryption-aws-kms-key-id"] = keyId
+	}
+	for name, value := range policy.fields {
+		fields[name] = value
+	}
+
+	conditions := []interface{}{
+		map[string]string{ "bucket": tn.Bucket },
+	}
+	for name, value := range fields {
+		conditions = append(conditions, map[string]string{ name: value })
+	}
+	if policy.maxSize > 0 {
+		conditions = append(conditions, []interface{}{ "content-length-range", policy.minSize, policy.maxSize })
+	}
+	document, err := json.Marshal(map[string]interface{}{
+		"expiration": now.Add(policy.expires).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(document)
+	fields["policy"] = encoded
+	fields["x-amz-signature"] = postPolicySignature(creds.SecretAccessKey, date, region, encoded)
+
+	return &presignedPost{
+		URL: fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", tn.Bucket, region),
+		Fields: fields,
+	}, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+/* Retention: objects older than their class's number of days are
+   deleted, by the "purge" command or by a job every server runs.
+   The class of an object is the scope of the key layout it was
+   uploaded under, see retentionClass; objects no layout claims are
+   left alone. Policies come from the JSON file named by
+   RETENTION_FILE, e.g.
+
+     {"days": {"device": 365, "download": 90, "unauthenticated": 14,
+               "inbound": 180},
+      "dry_run": false}
+
+   A class without a number of days is kept forever, and without
+   the file nothing is ever deleted. Age is the object's
+   LastModified, which for uploads is when they were uploaded.
+   With dry_run the job only logs what it would delete.
+
+   Every run is a row in log_purge_runs and every object it deletes
+   a row in log_purges; see schema.sql. Erasures (erasure.go) delete
+   through the same purger and are audited the same way. The
+   scheduled job starts a run per tenant at most once every
+   RetentionIntervalInHours, on whichever server gets there first.
+
+   Deleting an object in a versioned bucket only hides it; such
+   buckets need a lifecycle rule for noncurrent versions. */
+
+const (
+	RetentionIntervalInHours = 24
+	RetentionPollIntervalInMinutes = 60
+)
+
+var retentionClasses = []string{ "device", "download", "unauthenticated", "inbound" }
+
+type retentionConfig struct {
+	Days   map[string]int `json:"days"`
+	DryRun bool           `json:"dry_run"`
+}
+
+/* nil unless RETENTION_FILE is set */
+var retention *retentionConfig
+
+/* the names queueLog gives the logs it writes */
+var inboundKeyRE = regexp.MustCompile(`^/inbound/[0-9a-f]{16}$`)
+
+/* the scope of the first key layout the key matches, "device" for
+   the unscoped layouts, or "inbound"; "" for anything else, which
+   is never purged. That includes keys only the catch-all legacy
+   layout matches, as it can't tell logs from other objects. */
+func retentionClass(key string) string {
+	if inboundKeyRE.MatchString(key) {
+		return "inbound"
+	}
+	for _, layout := range keyLayouts {
+		if !layout.re.MatchString(key) {
+			continue
+		}
+		switch {
+			case layout.name == "legacy":
+				return ""
+			case layout.scope == "":
+				return "device"
+			default:
+				return layout.scope
+		}
+	}
+	return ""
+}
+
+func isRetentionClass(class string) bool {
+	for _, c := range retentionClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func loadRetention(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config := &retentionConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("bad retention file %s: %w", path, err)
+	}
+	for class, days := range config.Days {
+		if !isRetentionClass(class) {
+			return fmt.Errorf("unknown retention class %s in %s", class, path)
+		}
+		if days < 0 {
+			return fmt.Errorf("negative retention for %s in %s", class, path)
+		}
+		log.Printf("INFO: keeping %s logs for %d days", class, days)
+	}
+	retention = config
+	return nil
+}
+
+func initRetention() {
+	path := os.Getenv("RETENTION_FILE")
+	if path == "" {
+		log.Printf("INFO: no RETENTION_FILE, logs are kept forever")
+		return
+	}
+	if err := loadRetention(path); err != nil {
+		log.Fatal(err)
+	}
+}
+
+/* deletes objects MaxDeleteBatch at a time on behalf of one run;
+   call flush at the end for the last batch. progress, if set, is
+   called after every batch. */
+type purger struct {
+	tn       *tenant
+	run      *purgeRun
+	batch    []purgedObject
+	progress func (ctx context.Context)
+	/* called for each object once it is deleted and recorded */
+	deleted  func (ctx context.Context, object purgedObject) error
+}
+
+func (p *purger) add(ctx context.Context, object purgedObject) error {
+	p.batch = append(p.batch, object)
+	if len(p.batch) < MaxDeleteBatch {
+		return nil
+	}
+	return p.flush(ctx)
+}
+
+func (p *purger) flush(ctx context.Context) error {
+	batch := p.batch
+	p.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+	if p.run.dryRun {
+		for _, object := range batch {
+			log.Printf("INFO: dry run %d: would purge %s:%s (%s, %d bytes, %s)", p.run.id, p.tn.Name, object.key,
+				object.class, object.size, object.lastModified.Format(time.RFC3339))
+			p.run.objects++
+			p.run.bytes += object.size
+		}
+		if p.progress != nil {
+			p.progress(ctx)
+		}
+		return nil
+	}
+	keys := make([]string, len(batch))
+	for i, object := range batch {
+		keys[i] = object.key
+	}
+	failed, err := awsDeleteObjects(ctx, p.tn, keys)
+	if err != nil {
+		return err
+	}
+	deleted := make([]purgedObject, 0, len(batch))
+	for _, object := range batch {
+		if reason, ok := failed[object.key]; ok {
+			log.Printf("WARN: could not purge %s:%s: %s", p.tn.Name, object.key, reason)
+			p.run.failed++
+			continue
+		}
+		deleted = append(deleted, object)
+	}
+	if err := dbRecordPurges(ctx, p.run.id, p.tn, deleted); err != nil {
+		/* they are gone either way, so the log has to be the
+		   audit trail for these */
+		for _, object := range deleted {
+			log.Printf("ERROR: purge run %d deleted %s:%s without a record", p.run.id, p.tn.Name, object.key)
+		}
+		return err
+	}
+	for _, object := range deleted {
+		p.run.objects++
+		p.run.bytes += object.size
+		if p.deleted != nil {
+			if err := p.deleted(ctx, object); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("INFO: purge run %d: deleted %d objects from %s", p.run.id, len(deleted), p.tn.Name)
+	if p.progress != nil {
+		p.progress(ctx)
+	}
+	return nil
+}
+
+/* records how the run ended; a run cut short by shutdown is left
+   without finished_at */
+func finishPurgeRun(ctx context.Context, run *purgeRun, err error) {
+	if ctx.Err() != nil {
+		log.Printf("WARN: purge run %d interrupted", run.id)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: purge run %d failed: %s", run.id, err)
+		run.message = oneLine(err.Error())
+	}
+	log.Printf("INFO: purge run %d (%s %s, dry run %t): %d objects, %d bytes, %d failed",
+		run.id, run.kind, run.tenant, run.dryRun, run.objects, run.bytes, run.failed)
+	if err := dbFinishPurgeRun(ctx, run); err != nil {
+		log.Printf("ERROR: could not record purge run %d: %s", run.id, err)
+	}
+}
+
+/* deletes the tenant's expired objects, only those of class if
+   that is set */
+func purgeExpired(ctx context.Context, tn *tenant, run *purgeRun, class string) error {
+	now := time.Now()
+	p := &purger{ tn: tn, run: run }
+	var failed error
+	err := awsListObjects(ctx, tn, "", "", func (key string, info *awsObjectInfo) bool {
+		/* other tenants may live under prefixes of ours */
+		if owner, _ := tenantForObject(tn.Bucket, tn.key(key)); owner != tn {
+			return true
+		}
+		c := retentionClass(key)
+		days := retention.Days[c]
+		if c == "" || days <= 0 || (class != "" && c != class) {
+			return true
+		}
+		if now.Sub(info.lastModified) < time.Duration(days) * 24 * time.Hour {
+			return true
+		}
+		object := purgedObject{ key: key, class: c, size: info.size, lastModified: info.lastModified }
+		if err := p.add(ctx, object); err != nil {
+			failed = err
+			return false
+		}
+		return true
+	})
+	if err == nil {
+		err = failed
+	}
+	if err == nil {
+		err = p.flush(ctx)
+	}
+	return err
+}
+
+/* logprocessor purge [-tenant name] [-class class] [-dry-run] */
+func runPurge(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	name := flags.String("tenant", "", "only purge this tenant")
+	class := flags.String("class", "", "only purge this class of logs")
+	dryRun := flags.Bool("dry-run", false, "list what would be purged without deleting it")
+	flags.Parse(args)
+	if retention == nil {
+		return fmt.Errorf("no retention policies, set RETENTION_FILE")
+	}
+	if *class != "" && !isRetentionClass(*class) {
+		return fmt.Errorf("unknown retention class %s", *class)
+	}
+	tenants := allTenants()
+	if *name != "" {
+		tn := tenantByName(*name)
+		if tn == nil {
+			return fmt.Errorf("no tenant %s", *name)
+		}
+		tenants = []*tenant{ tn }
+	}
+	var failed error
+	for _, tn := range tenants {
+		run := &purgeRun{ kind: "retention", tenant: tn.Name, dryRun: *dryRun || retention.DryRun }
+		if err := dbStartPurgeRun(ctx, run); err != nil {
+			return err
+		}
+		err := purgeExpired(ctx, tn, run, *class)
+		finishPurgeRun(ctx, run, err)
+		if err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+/* purges every tenant once per RetentionIntervalInHours, until
+   ctx is done */
+func runRetentionWorker(ctx context.Context) {
+	if retention == nil {
+		return
+	}
+	ticker := time.NewTicker(RetentionPollIntervalInMinutes * time.Minute)
+	defer ticker.Stop()
+	for {
+		for _, tn := range allTenants() {
+			if ctx.Err() != nil {
+				return
+			}
+			run := &purgeRun{ kind: "retention", tenant: tn.Name, dryRun: retention.DryRun }
+			claimed, err := dbClaimPurgeRun(ctx, run, RetentionIntervalInHours * time.Hour)
+			if err != nil {
+				log.Printf("ERROR: could not claim purge run for %s: %s", tn.Name, err)
+				continue
+			}
+			if !claimed {
+				continue
+			}
+			finishPurgeRun(ctx, run, purgeExpired(ctx, tn, run, ""))
+		}
+		select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+		}
+	}
+}
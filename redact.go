@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+)
+
+/* Redaction of log text on its way out. A rule finds something,
+   either with its own pattern or with one of the named detectors
+   below, and replaces each match with a mask ("[email]") or a
+   keyed hash ("[email:3fa9c0d1e2b4]"), which keeps matches apart
+   without giving them away. A policy is a list of rules; callers,
+   named by the RedactionCallerHeader our gateway sets, map to
+   policies, and everyone else gets the default policy. The header
+   only counts on requests from TRUSTED_PROXIES (see httputil.go),
+   anyone else could name whichever caller has the weakest policy.
+
+   The rules come from the JSON file named by REDACTION_RULES_FILE:
+
+     {"rules": [{"name": "email", "detector": "email", "action": "hash"},
+                {"name": "ticket", "pattern": "TCK-[0-9]+", "mask": "[ticket]"}],
+      "policies": {"default": ["email", "ticket"], "support": ["ticket"]},
+      "callers": {"support-console": "support"},
+      "default_policy": "default"}
+
+   Without a file every detector masks for everyone. Hashes use the
+   key in REDACTION_HASH_KEY; without one they are only comparable
+   within one run of the server.
+
+   Text is redacted a line at a time, so nothing a rule could match
+   may span lines. */
+
+const (
+	RedactionCallerHeader = "X-Caller-Id"
+	MaxRedactedLineLength = 64 << 10
+	RedactionHashBytes = 6
+)
+
+type redactionDetector struct {
+	re    *regexp.Regexp
+	valid func(match []byte) bool
+}
+
+func isIP(match []byte) bool {
+	return net.ParseIP(string(match)) != nil
+}
+
+var redactionDetectors = map[string]*redactionDetector{
+	"email": {
+		re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	},
+	"phone": {
+		/* separators are required, so timestamps and ids don't match */
+		re: regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b|\+\d{8,15}\b`),
+	},
+	"ipv4": {
+		re: regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`),
+		valid: isIP,
+	},
+	"ipv6": {
+		re: regexp.MustCompile(`(?i)\b(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}\b`),
+		valid: isIP,
+	},
+	"meeting_url": {
+		re: regexp.MustCompile(`https?://(?:[A-Za-z0-9-]+\.)*fuze\.com/[^\s"'<>]*`),
+	},
+}
+
+type redactionRule struct {
+	Name     string `json:"name"`
+	Detector string `json:"detector"`
+	Pattern  string `json:"pattern"`
+	Action   string `json:"action"`
+	Mask     string `json:"mask"`
+
+	re    *regexp.Regexp
+	valid func(match []byte) bool
+}
+
+type redactionConfig struct {
+	Rules         []*redactionRule    `json:"rules"`
+	Policies      map[string][]string `json:"policies"`
+	Callers       map[string]string   `json:"callers"`
+	DefaultPolicy string              `json:"default_policy"`
+}
+
+type redactionPolicy struct {
+	name  string
+	rules []*redactionRule
+}
+
+var (
+	redactionPolicies = map[string]*redactionPolicy{}
+	redactionCallers = map[string]string{}
+	defaultRedactionPolicy = ""
+	redactionHashKey []byte
+)
+
+func defaultRedactionConfig() *redactionConfig {
+	config := &redactionConfig{ Policies: map[string][]string{}, DefaultPolicy: "default" }
+	for name := range redactionDetectors {
+		config.Rules = append(config.Rules, &redactionRule{ Name: name, Detector: name })
+		config.Policies["default"] = append(config.Policies["default"], name)
+	}
+	sort.Strings(config.Policies["default"])
+	return config
+}
+
+func (rule *redactionRule) compile() error {
+	switch {
+		case rule.Name == "":
+			return fmt.Errorf("redaction rule without a name")
+		case rule.Detector != "" && rule.Pattern != "":
+			return fmt.Errorf("redaction rule %s has both a detector and a pattern", rule.Name)
+		case rule.Detector != "":
+			detector, ok := redactionDetectors[rule.Detector]
+			if !ok {
+				return fmt.Errorf("redaction rule %s: no detector %s", rule.Name, rule.Detector)
+			}
+			rule.re = detector.re
+			rule.valid = detector.valid
+		case rule.Pattern != "":
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("redaction rule %s: %w", rule.Name, err)
+			}
+			rule.re = re
+		default:
+			return fmt.Errorf("redaction rule %s has no detector or pattern", rule.Name)
+	}
+	switch rule.Action {
+		case "":
+			rule.Action = "mask"
+		case "mask", "hash":
+		default:
+			return fmt.Errorf("redaction rule %s: unknown action %s", rule.Name, rule.Action)
+	}
+	if rule.Mask == "" {
+		rule.Mask = "[" + rule.Name + "]"
+	}
+	return nil
+}
+
+func applyRedactionConfig(config *redactionConfig) error {
+	rules := map[string]*redactionRule{}
+	for _, rule := range config.Rules {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+		rules[rule.Name] = rule
+	}
+	policies := map[string]*redactionPolicy{}
+	for name, ruleNames := range config.Policies {
+		policy := &redactionPolicy{ name: name }
+		for _, ruleName := range ruleNames {
+			rule, ok := rules[ruleName]
+			if !ok {
+				return fmt.Errorf("redaction policy %s: no rule %s", name, ruleName)
+			}
+			policy.rules = append(policy.rules, rule)
+		}
+		policies[name] = policy
+	}
+	for caller, name := range config.Callers {
+		if _, ok := policies[name]; !ok {
+			return fmt.Errorf("redaction caller %s: no policy %s", caller, name)
+		}
+	}
+	if _, ok := policies[config.DefaultPolicy]; !ok {
+		return fmt.Errorf("no default redaction policy %q", config.DefaultPolicy)
+	}
+	redactionPolicies = policies
+	redactionCallers = config.Callers
+	defaultRedactionPolicy = config.DefaultPolicy
+	return nil
+}
+
+func initRedaction() {
+	config := defaultRedactionConfig()
+	if path := os.Getenv("REDACTION_RULES_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config = &redactionConfig{}
+		if err := json.Unmarshal(data, config); err != nil {
+			log.Fatalf("bad redaction rules file %s: %s", path, err)
+		}
+	}
+	if err := applyRedactionConfig(config); err != nil {
+		log.Fatal(err)
+	}
+	if key := os.Getenv("REDACTION_HASH_KEY"); key != "" {
+		redactionHashKey = []byte(key)
+	} else {
+		redactionHashKey = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, redactionHashKey); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("WARN: no REDACTION_HASH_KEY, redaction hashes will change on restart")
+	}
+	log.Printf("INFO: %d redaction policies, default %s", len(redactionPolicies), defaultRedactionPolicy)
+}
+
+/* the policy name for a request, turned into a redactor with
+   newRedactor; exports run long after their request, so they keep
+   the name and check it is still in redactionPolicies first */
+func requestRedactionPolicy(req *http.Request) string {
+	if !fromTrustedProxy(req) {
+		return defaultRedactionPolicy
+	}
+	if name, ok := redactionCallers[req.Header.Get(RedactionCallerHeader)]; ok {
+		return name
+	}
+	return defaultRedactionPolicy
+}
+
+/* one per response; counts what it replaced, per rule */
+type redactor struct {
+	policy *redactionPolicy
+	counts map[string]int
+}
+
+/* nil, which redacts nothing, for unknown or empty policies */
+func newRedactor(name string) *redactor {
+	policy, ok := redactionPolicies[name]
+	if !ok || len(policy.rules) == 0 {
+		return nil
+	}
+	return &redactor{ policy: policy, counts: map[string]int{} }
+}
+
+func (rd *redactor) replacement(rule *redactionRule, match []byte) []byte {
+	if rule.Action != "hash" {
+		return []byte(rule.Mask)
+	}
+	mac := hmac.New(sha256.New, redactionHashKey)
+	mac.Write(match)
+	sum := hex.EncodeToString(mac.Sum(nil)[:RedactionHashBytes])
+	return []byte("[" + rule.Name + ":" + sum + "]")
+}
+
+func (rd *redactor) redact(line []byte) []byte {
+	for _, rule := range rd.policy.rules {
+		line = rule.re.ReplaceAllFunc(line, func (match []byte) []byte {
+			if rule.valid != nil && !rule.valid(match) {
+				return match
+			}
+			rd.counts[rule.Name]++
+			return rd.replacement(rule, match)
+		})
+	}
+	return line
+}
+
+func (rd *redactor) total() int {
+	if rd == nil {
+		return 0
+	}
+	total := 0
+	for _, n := range rd.counts {
+		total += n
+	}
+	return total
+}
+
+func (rd *redactor) countsJSON() string {
+	if rd == nil {
+		return "{}"
+	}
+	b, err := json.Marshal(rd.counts)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+/* redacts whole lines on their way to w; call flush once done to
+   write out an unterminated last line */
+type redactingWriter struct {
+	w       io.Writer
+	rd      *redactor
+	pending []byte
+}
+
+/* w itself if there is nothing to redact */
+func (rd *redactor) writer(w io.Writer) io.Writer {
+	if rd == nil {
+		return w
+	}
+	return &redactingWriter{ w: w, rd: rd }
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	rw.pending = append(rw.pending, p...)
+	for {
+		end := bytes.IndexByte(rw.pending, '\n') + 1
+		if end == 0 {
+			if len(rw.pending) < MaxRedactedLineLength {
+				return len(p), nil
+			}
+			end = len(rw.pending)
+		}
+		if _, err := rw.w.Write(rw.rd.redact(rw.pending[:end])); err != nil {
+			return 0, err
+		}
+		rw.pending = append(rw.pending[:0], rw.pending[end:]...)
+	}
+}
+
+func (rw *redactingWriter) flush() error {
+	if len(rw.pending) == 0 {
+		return nil
+	}
+	_, err := rw.w.Write(rw.rd.redact(rw.pending))
+	rw.pending = rw.pending[:0]
+	return err
+}
+
+/* for follow mode, which flushes after every batch */
+func (rw *redactingWriter) Flush() {
+	if rw.flush() != nil {
+		return
+	}
+	if flusher, ok := rw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/* flushes w if it is a redactingWriter */
+func flushRedaction(w io.Writer) error {
+	if rw, ok := w.(*redactingWriter); ok {
+		return rw.flush()
+	}
+	return nil
+}
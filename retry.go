@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/go-sql-driver/mysql"
+)
+
+/* A retryPolicy is shared by every call of one kind (list, download,
+   ...), but the budget is per call: each call gets maxAttempts tries
+   and gives up once deadline has passed since its first try. Delays
+   grow exponentially from baseDelay to maxDelay with full jitter. */
+type retryPolicy struct {
+	name        string
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	deadline    time.Duration
+}
+
+var (
+	listRetry = &retryPolicy{ name: "list", maxAttempts: 5, baseDelay: 100 * time.Millisecond, maxDelay: 5 * time.Second, deadline: time.Minute }
+	downloadRetry = &retryPolicy{ name: "download", maxAttempts: 8, baseDelay: 100 * time.Millisecond, maxDelay: 10 * time.Second, deadline: 5 * time.Minute }
+	uploadRetry = &retryPolicy{ name: "upload", maxAttempts: 5, baseDelay: 200 * time.Millisecond, maxDelay: 10 * time.Second, deadline: 5 * time.Minute }
+	deleteRetry = &retryPolicy{ name: "delete", maxAttempts: 5, baseDelay: 200 * time.Millisecond, maxDelay: 10 * time.Second, deadline: 2 * time.Minute }
+	/* moving a whole object can take long; an export streams into
+	   its upload for up to MaxExportDurationInMinutes */
+	objectDownloadRetry = &retryPolicy{ name: "object_download", maxAttempts: 8, baseDelay: 100 * time.Millisecond, maxDelay: 10 * time.Second, deadline: 30 * time.Minute }
+	objectUploadRetry = &retryPolicy{ name: "object_upload", maxAttempts: 5, baseDelay: 200 * time.Millisecond, maxDelay: 10 * time.Second, deadline: MaxExportDurationInMinutes * time.Minute + 5 * time.Minute }
+	dbRetry = &retryPolicy{ name: "db", maxAttempts: 3, baseDelay: 50 * time.Millisecond, maxDelay: time.Second, deadline: 10 * time.Second }
+)
+
+/* published on /debug/vars as retries.<policy>.<counter>, see
+   serveMetrics */
+var retryMetrics = expvar.NewMap("retries")
+
+/* where /debug/vars is served; it also has the command line and
+   memory stats, so by default nothing but the host can see it */
+const DefaultMetricsAddr = "127.0.0.1:9090"
+
+/* serves /debug/vars on METRICS_ADDR until ctx is done */
+func serveMetrics(ctx context.Context) {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = DefaultMetricsAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	server := &http.Server{ Addr: addr, Handler: mux }
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("ERROR: could not serve metrics on %s: %s", addr, err)
+	}
+}
+
+/* wraps errors that must not be retried whatever they are,
+   e.g. an upload whose body has already been consumed */
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func isRetryable(err error) bool {
+	var permanent *permanentError
+	var aerr awserr.Error
+	var merr *mysql.MySQLError
+	switch {
+		case err == nil:
+			return false
+		case errors.As(err, &permanent):
+			return false
+		case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			return false
+		case errors.Is(err, sql.ErrNoRows):
+			return false
+		case errors.As(err, &merr):
+			/* deadlock and lock wait timeout are worth another go,
+			   anything else the server rejected will be rejected again */
+			return merr.Number == 1213 || merr.Number == 1205
+		case errors.As(err, &aerr):
+			switch aerr.Code() {
+				case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, s3.ErrCodeNoSuchUpload,
+				     "NotFound", "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch",
+				     "InvalidObjectState", request.CanceledErrorCode:
+					return false
+			}
+			var rf awserr.RequestFailure
+			if errors.As(err, &rf) {
+				status := rf.StatusCode()
+				return status == 0 || status == 408 || status == 429 || status >= 500
+			}
+			return true
+		default:
+			return true
+	}
+}
+
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	d := p.baseDelay << uint(attempt - 1)
+	if d <= 0 || d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func (p *retryPolicy) count(counter string) {
+	retryMetrics.Add(p.name + "." + counter, 1)
+}
+
+/* the deadline runs out as an error of its own, not as the
+   caller's context being done */
+func (p *retryPolicy) expired(what string, start time.Time, attempt int, err error) error {
+	p.count("exhausted")
+	log.Printf("ERROR: %s %s: giving up after %s and %d tries: %s", p.name, what, time.Since(start).Round(time.Millisecond), attempt, err)
+	return fmt.Errorf("%s %s: no success within %s: %v", p.name, what, p.deadline, err)
+}
+
+func (p *retryPolicy) do(ctx context.Context, what string, fn func (ctx context.Context) error) error {
+	/* the deadline bounds the tries themselves, not only the
+	   waits between them, so one that hangs is cut off too */
+	callerCtx := ctx
+	if p.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.deadline)
+		defer cancel()
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		p.count("attempts")
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if callerCtx.Err() != nil {
+			return callerCtx.Err()
+		}
+		if ctx.Err() != nil {
+			return p.expired(what, start, attempt, err)
+		}
+		if !isRetryable(err) {
+			p.count("permanent")
+			return err
+		}
+		if attempt >= p.maxAttempts {
+			p.count("exhausted")
+			log.Printf("ERROR: %s %s: giving up after %d tries: %s", p.name, what, attempt, err)
+			return err
+		}
+		delay := p.delay(attempt)
+		if p.deadline > 0 && time.Since(start) + delay > p.deadline {
+			p.count("exhausted")
+			log.Printf("ERROR: %s %s: giving up after %s: %s", p.name, what, time.Since(start).Round(time.Millisecond), err)
+			return err
+		}
+		p.count("retries")
+		log.Printf("WARN: %s %s: %s (try %d of %d)", p.name, what, err, attempt, p.maxAttempts)
+		select {
+			case <-ctx.Done():
+				if callerCtx.Err() != nil {
+					return callerCtx.Err()
+				}
+				return p.expired(what, start, attempt, err)
+			case <-time.After(delay):
+		}
+	}
+}
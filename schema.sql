@@ -0,0 +1,112 @@
+-- Tables owned by this service. The device, launch_tokens,
+-- meeting_instances and meeting_participants tables belong to
+-- meetings-goservices and are only read here (device.organization_id
+-- only when tenants are routed by organization, device.user_id and
+-- launch_tokens.device_id only by erasures).
+
+CREATE TABLE IF NOT EXISTS log_export_jobs (
+	id          BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	state       VARCHAR(16) NOT NULL,  -- Queued, Running, Done, Failed, Expired
+	params      TEXT NOT NULL,         -- query string of the POST
+	ticket_hash CHAR(64),              -- hex SHA-256 of the ticket the POST returned
+	s3_key      VARCHAR(1024),         -- NULL again once the expired zip is deleted
+	message     TEXT,
+	archives    INT NOT NULL DEFAULT 0,
+	skipped     TEXT,                  -- json, as in X-Skipped-Keys
+	devices     TEXT,                  -- space-separated devices whose logs the zip holds
+	created_at  DATETIME NOT NULL,
+	updated_at  DATETIME NOT NULL,
+	expires_at  DATETIME,
+	KEY state_id (state, id)
+);
+
+-- Index of the objects clients uploaded, from S3 ObjectCreated
+-- events, multipart completions and "logprocessor backfill-index".
+-- s3_key is binary so it sorts the way S3 lists.
+CREATE TABLE IF NOT EXISTS uploads (
+	id                   BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	bucket               VARCHAR(63) CHARACTER SET ascii NOT NULL,
+	s3_key               VARBINARY(1024) NOT NULL,
+	device_id            VARCHAR(128),          -- device id, download token or client
+	size                 BIGINT NOT NULL,
+	etag                 VARCHAR(64),
+	meeting_instance_id  BIGINT,
+	started_at           DATETIME,              -- timestamp in the key, if it has one
+	uploaded_at          DATETIME NOT NULL,     -- S3 LastModified
+	source               VARCHAR(16) NOT NULL,  -- upload_url, upload_post, multipart, logs_post, backfill, ...
+	recorded_at          DATETIME NOT NULL,
+	UNIQUE KEY bucket_key (bucket, s3_key),
+	KEY meeting_instance (meeting_instance_id),
+	KEY bucket_device (bucket, device_id)
+);
+
+-- How far the uploads index can be trusted, per tenant (bucket and
+-- prefix): every upload is in it from when a full backfill-index
+-- run started, given events come through SQS.
+CREATE TABLE IF NOT EXISTS upload_index_watermarks (
+	bucket         VARCHAR(63) CHARACTER SET ascii NOT NULL,
+	prefix         VARBINARY(1024) NOT NULL,
+	backfilled_at  DATETIME NOT NULL,
+	PRIMARY KEY (bucket, prefix)
+);
+
+-- What an upload URL was requested for, recorded when a presigned
+-- PUT is handed out; PUTs can't carry the metadata POST and
+-- multipart uploads do. Read when the upload is indexed.
+CREATE TABLE IF NOT EXISTS upload_attributions (
+	bucket               VARCHAR(63) CHARACTER SET ascii NOT NULL,
+	s3_key               VARBINARY(1024) NOT NULL,
+	device_id            VARCHAR(128),
+	client               VARCHAR(128),
+	meeting_instance_id  BIGINT,
+	created_at           DATETIME NOT NULL,
+	PRIMARY KEY (bucket, s3_key)
+);
+
+-- Purges: a retention run ("logprocessor purge" or the scheduled
+-- job) or an erasure job's deletions, per tenant. Dry runs only
+-- count; finished_at stays NULL for runs that were interrupted.
+CREATE TABLE IF NOT EXISTS log_purge_runs (
+	id           BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	kind         VARCHAR(16) NOT NULL,  -- retention, erasure
+	tenant       VARCHAR(64) NOT NULL,
+	job_id       BIGINT,                -- log_erasure_jobs.id for erasures
+	dry_run      BOOLEAN NOT NULL,
+	objects      INT NOT NULL DEFAULT 0,
+	bytes        BIGINT NOT NULL DEFAULT 0,
+	failed       INT NOT NULL DEFAULT 0,
+	message      TEXT,
+	started_at   DATETIME NOT NULL,
+	finished_at  DATETIME,
+	KEY kind_tenant_started (kind, tenant, started_at),
+	KEY job (job_id)
+);
+
+-- Audit of every object a purge run deleted.
+CREATE TABLE IF NOT EXISTS log_purges (
+	id             BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	run_id         BIGINT NOT NULL,
+	bucket         VARCHAR(63) CHARACTER SET ascii NOT NULL,
+	s3_key         VARBINARY(1024) NOT NULL,
+	class          VARCHAR(16) NOT NULL,  -- device, download, unauthenticated, inbound; erasures also export, other
+	size           BIGINT NOT NULL,
+	last_modified  DATETIME NOT NULL,
+	purged_at      DATETIME NOT NULL,
+	KEY run (run_id),
+	KEY bucket_key (bucket, s3_key)
+);
+
+-- Erasure requests, POST /v1/admin/erasures. objects, bytes and
+-- failed add up the job's purge runs and are updated as it goes.
+CREATE TABLE IF NOT EXISTS log_erasure_jobs (
+	id          BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	state       VARCHAR(16) NOT NULL,  -- Queued, Running, Done, Failed
+	params      TEXT NOT NULL,         -- device_id..., user_id, dry_run, scan
+	objects     INT NOT NULL DEFAULT 0,
+	bytes       BIGINT NOT NULL DEFAULT 0,
+	failed      INT NOT NULL DEFAULT 0,
+	message     TEXT,
+	created_at  DATETIME NOT NULL,
+	updated_at  DATETIME NOT NULL,
+	KEY state_id (state, id)
+);
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
 	"log"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	ShutdownTimeoutInSeconds = 10
 )
 
 func logsV1Handler(w http.ResponseWriter, req *http.Request) {
@@ -34,6 +44,37 @@ func healthHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func meetingLogsHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+		case "GET":
+			meetingLogsGet(req)(w)
+		default:
+			httpBadRequest(w)
+	}
+}
+
+func logExportsHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+		case "GET":
+			logExportGet(req)(w)
+		case "POST":
+			logExportPost(req)(w)
+		default:
+			httpBadRequest(w)
+	}
+}
+
+func erasuresHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+		case "GET":
+			erasureGet(req)(w)
+		case "POST":
+			erasurePost(req)(w)
+		default:
+			httpBadRequest(w)
+	}
+}
+
 func logUploadURLHandler(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 		case "GET":
@@ -43,6 +84,35 @@ func logUploadURLHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func multipartHandler(post func(*http.Request) func(http.ResponseWriter)) func (http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+			case "POST":
+				post(req)(w)
+			default:
+				httpBadRequest(w)
+		}
+	}
+}
+
+func multipartPartHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+		case "GET":
+			multipartPartGet(req)(w)
+		default:
+			httpBadRequest(w)
+	}
+}
+
+func uploadEventsHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+		case "POST":
+			uploadEventsPost(req)(w)
+		default:
+			httpBadRequest(w)
+	}
+}
+
 func makeReportHandler(crash bool, v2 bool) func (http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		switch req.Method {
@@ -61,13 +131,74 @@ func main() {
 		log.Fatal(err)
 	}
 	defer dbClose()
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/v1/logs", logsV1Handler)
-	http.HandleFunc("/v2/logs", logsV2Handler)
-	http.HandleFunc("/v1/log_upload_url", logUploadURLHandler)
-	http.HandleFunc("/v1/feedback", makeReportHandler(false, false))
-	http.HandleFunc("/v2/feedback/report", makeReportHandler(false, true))
-	http.HandleFunc("/v1/crashreport", makeReportHandler(true, false))
-	http.HandleFunc("/v2/feedback/crashreport", makeReportHandler(true, true))
-	http.ListenAndServe(":8080", nil)
+	initTenants()
+	initTrustedProxies()
+	initRetention()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+			case "backfill-index":
+				err = runBackfillIndex(context.Background(), os.Args[2:])
+			case "purge":
+				err = runPurge(context.Background(), os.Args[2:])
+			case "decrypt":
+				err = runDecrypt(context.Background(), os.Args[2:])
+			default:
+				err = fmt.Errorf("unknown command %s", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	initUploadEventQueue()
+	initQuarantineScanQueue()
+	initRedaction()
+	/* not http.DefaultServeMux, which expvar puts /debug/vars on */
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/v1/logs", logsV1Handler)
+	mux.HandleFunc("/v2/logs", logsV2Handler)
+	mux.HandleFunc("/v1/meeting_logs", meetingLogsHandler)
+	mux.HandleFunc("/v1/log_exports", logExportsHandler)
+	mux.HandleFunc("/v1/log_upload_url", logUploadURLHandler)
+	mux.HandleFunc("/v1/log_upload_url/multipart/initiate", multipartHandler(multipartInitiatePost))
+	mux.HandleFunc("/v1/log_upload_url/multipart/part", multipartPartHandler)
+	mux.HandleFunc("/v1/log_upload_url/multipart/complete", multipartHandler(multipartCompletePost))
+	mux.HandleFunc("/v1/log_upload_url/multipart/abort", multipartHandler(multipartAbortPost))
+	mux.HandleFunc("/v1/upload_events", uploadEventsHandler)
+	mux.HandleFunc("/v1/admin/erasures", erasuresHandler)
+	mux.HandleFunc("/v1/feedback", makeReportHandler(false, false))
+	mux.HandleFunc("/v2/feedback/report", makeReportHandler(false, true))
+	mux.HandleFunc("/v1/crashreport", makeReportHandler(true, false))
+	mux.HandleFunc("/v2/feedback/crashreport", makeReportHandler(true, true))
+	/* every request context hangs off this one, so shutting down
+	   stops in-flight S3 work instead of waiting for it */
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runExportWorker(baseCtx)
+	go runUploadEventWorker(baseCtx)
+	go runRetentionWorker(baseCtx)
+	go runErasureWorker(baseCtx)
+	go serveMetrics(baseCtx)
+	server := &http.Server{
+		Addr: ":8080",
+		Handler: mux,
+		BaseContext: func (net.Listener) context.Context { return baseCtx },
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("INFO: shutting down on %s", sig)
+		cancel()
+		shutdownCtx, done := context.WithTimeout(context.Background(), ShutdownTimeoutInSeconds * time.Second)
+		defer done()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
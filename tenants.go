@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/* Where a tenant's logs live. Everything a request reads or writes
+   goes to the tenant it resolves to: first by the organization of
+   its device, then by the Host it was sent to, else the default
+   tenant. Tenants come from the JSON file named by TENANTS_FILE,
+   e.g.
+
+     [{"name": "eu", "bucket": "...", "region": "eu-central-1",
+       "prefix": "", "hosts": ["logs.eu.example.com"],
+       "organizations": [1234]}]
+
+   A tenant named "default" in the file replaces the built-in one.
+   Prefix is put in front of every key verbatim, so several tenants
+   can share a bucket.
+
+   Encryption is the S3 server-side encryption for every object
+   written to the tenant, "AES256" or "aws:kms" with kms_key_id (or
+   the account's default key if that is empty); presigned uploads
+   have to send it too. With envelope set, logs we store ourselves
+   are also encrypted before they leave us, under a data key from
+   kms_key_id; see envelope.go. */
+type tenant struct {
+	Name          string   `json:"name"`
+	Bucket        string   `json:"bucket"`
+	Region        string   `json:"region"`
+	Prefix        string   `json:"prefix"`
+	Hosts         []string `json:"hosts"`
+	Organizations []int64  `json:"organizations"`
+	Encryption    string   `json:"encryption"`
+	KMSKeyId      string   `json:"kms_key_id"`
+	Envelope      bool     `json:"envelope"`
+}
+
+var defaultTenant = &tenant{ Name: "default", Bucket: "mbk-upload-bucket" }
+
+var (
+	tenantsByName = map[string]*tenant{ "default": defaultTenant }
+	tenantsByHost = map[string]*tenant{}
+	tenantsByOrganization = map[int64]*tenant{}
+)
+
+func (tn *tenant) key(key string) string {
+	return tn.Prefix + key
+}
+
+func (tn *tenant) clients() *awsRegionClients {
+	return awsClientsFor(tn.Region)
+}
+
+/* server-side encryption and KMS key id for the objects we write,
+   both empty for none */
+func (tn *tenant) sse() (string, string) {
+	if tn.Encryption != s3.ServerSideEncryptionAwsKms {
+		return tn.Encryption, ""
+	}
+	return tn.Encryption, tn.KMSKeyId
+}
+
+func loadTenants(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tenants []*tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return fmt.Errorf("bad tenants file %s: %w", path, err)
+	}
+	for _, tn := range tenants {
+		if tn.Name == "" || tn.Bucket == "" {
+			return fmt.Errorf("tenant without name or bucket in %s", path)
+		}
+		switch tn.Encryption {
+			case "", s3.ServerSideEncryptionAes256:
+				if tn.KMSKeyId != "" && !tn.Envelope {
+					return fmt.Errorf("tenant %s has a kms_key_id but no aws:kms encryption", tn.Name)
+				}
+			case s3.ServerSideEncryptionAwsKms:
+			default:
+				return fmt.Errorf("tenant %s has unknown encryption %s", tn.Name, tn.Encryption)
+		}
+		if tn.Envelope && tn.KMSKeyId == "" {
+			return fmt.Errorf("tenant %s needs a kms_key_id for envelope encryption", tn.Name)
+		}
+		if tn.Name == "default" {
+			defaultTenant = tn
+		}
+		tenantsByName[tn.Name] = tn
+		for _, host := range tn.Hosts {
+			tenantsByHost[strings.ToLower(host)] = tn
+		}
+		for _, org := range tn.Organizations {
+			tenantsByOrganization[org] = tn
+		}
+		log.Printf("INFO: tenant %s in s3://%s/%s (%s)", tn.Name, tn.Bucket, tn.Prefix, tn.clients().region)
+	}
+	return nil
+}
+
+func initTenants() {
+	if path := os.Getenv("TENANTS_FILE"); path != "" {
+		if err := loadTenants(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+/* nil if there is no such tenant */
+func tenantByName(name string) *tenant {
+	if name == "" {
+		return defaultTenant
+	}
+	return tenantsByName[name]
+}
+
+/* every tenant, by name */
+func allTenants() []*tenant {
+	names := make([]string, 0, len(tenantsByName))
+	for name := range tenantsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tenants := make([]*tenant, len(names))
+	for i, name := range names {
+		tenants[i] = tenantsByName[name]
+	}
+	return tenants
+}
+
+/* the tenant whose bucket and prefix hold bucket:key, and key
+   without the prefix; nil if none does */
+func tenantForObject(bucket string, key string) (*tenant, string) {
+	var found *tenant
+	for _, tn := range tenantsByName {
+		if tn.Bucket == bucket && strings.HasPrefix(key, tn.Prefix) &&
+		   (found == nil || len(tn.Prefix) > len(found.Prefix)) {
+			found = tn
+		}
+	}
+	if found == nil {
+		return nil, ""
+	}
+	return found, strings.TrimPrefix(key, found.Prefix)
+}
+
+/* The tenant of a request: the one of its device's organization if
+   it has one, since that is where the organization's logs have to
+   stay whatever host the client talks to; else the one of the Host
+   the request was sent to, else the default tenant. deviceId may be
+   empty if the request has no device. */
+func requestTenant(ctx context.Context, req *http.Request, deviceId string) (*tenant, error) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	fallback := defaultTenant
+	if tn, ok := tenantsByHost[strings.ToLower(host)]; ok {
+		fallback = tn
+	}
+	if deviceId == "" {
+		return fallback, nil
+	}
+	return deviceTenant(ctx, deviceId, fallback)
+}
+
+/* the tenant of the device's organization, or fallback */
+func deviceTenant(ctx context.Context, deviceId string, fallback *tenant) (*tenant, error) {
+	if len(tenantsByOrganization) == 0 {
+		return fallback, nil
+	}
+	org, err := dbDeviceOrganization(ctx, deviceId)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up organization of %s: %w", deviceId, err)
+	}
+	if tn, ok := tenantsByOrganization[org]; ok {
+		return tn, nil
+	}
+	return fallback, nil
+}
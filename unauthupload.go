@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+/* Uploads without a token, device_id or download_token come from
+   installers that fail before anyone has signed in, so anyone can
+   ask for one. They are only handed out to known clients, a limited
+   number per address, short-lived, and cannot be read until the
+   quarantine scanner has tagged them QuarantineCleared, see
+   checkQuarantine. The scanner learns of them from the upload
+   events, see initQuarantineScanQueue.
+
+   Clients that pass post=true (or max_size) get a size-capped POST,
+   which also tags the upload as pending. Installers already out
+   there only know how to PUT, so without it they still get a PUT,
+   its Content-Length signed when they pass content_length. That is
+   deprecated: the size of a PUT without content_length is only
+   bounded by S3, and the response's deprecation field says so. Once the
+   installers have moved to post=true the PUT goes away. */
+
+const (
+	UnauthenticatedUploadURLExpiry = 15 * time.Minute
+	MaxUnauthenticatedUploadSizeInBytes = 64 << 20
+	MaxUnauthenticatedURLsPerHour = 20
+	MaxTrackedUploadAddresses = 100000
+	UnauthenticatedPutDeprecation = "deprecated: pass post=true for a size-capped POST"
+)
+
+var unauthenticatedClients = map[string]bool{
+	"wininstaller": true,
+	"macinstaller": true,
+}
+
+/* optional proof-of-work or captcha check, e.g. of a challenge
+   parameter; nil lets every allowed client through */
+var unauthenticatedChallenge func(req *http.Request) (bool, error)
+
+/* fixed one hour windows per address */
+type uploadLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	entries map[string]*uploadLimiterEntry
+}
+
+type uploadLimiterEntry struct {
+	start time.Time
+	count int
+}
+
+var unauthenticatedLimiter = &uploadLimiter{
+	limit: MaxUnauthenticatedURLsPerHour,
+	window: time.Hour,
+	entries: map[string]*uploadLimiterEntry{},
+}
+
+func (l *uploadLimiter) allow(addr string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) >= MaxTrackedUploadAddresses {
+		for a, e := range l.entries {
+			if now.Sub(e.start) >= l.window {
+				delete(l.entries, a)
+			}
+		}
+	}
+	e, ok := l.entries[addr]
+	if !ok || now.Sub(e.start) >= l.window {
+		if !ok && len(l.entries) >= MaxTrackedUploadAddresses {
+			/* still full of live windows, better to refuse than
+			   to let the map grow without bound */
+			return false
+		}
+		e = &uploadLimiterEntry{ start: now }
+		l.entries[addr] = e
+	}
+	if e.count >= l.limit {
+		return false
+	}
+	e.count++
+	return true
+}
+
+/* the load balancer appends the address it saw to X-Forwarded-For,
+   anything to the left of that is up to the client; and from anyone
+   but the load balancer (see TRUSTED_PROXIES) all of it is */
+func requestAddress(req *http.Request) string {
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" && fromTrustedProxy(req) {
+		hops := strings.Split(fwd, ",")
+		return strings.TrimSpace(hops[len(hops) - 1])
+	}
+	return peerAddress(req)
+}
+
+/* applies the restrictions above to uur; fail is nil if the
+   upload may go ahead */
+func checkUnauthenticatedUpload(req *http.Request, uur *uploadURLRequest) (fail func(http.ResponseWriter)) {
+	if !unauthenticatedClients[uur.client] {
+		log.Printf("WARN unauthenticated upload from unknown client: %s", uur.client)
+		return httpForbidden
+	}
+	if unauthenticatedChallenge != nil {
+		ok, err := unauthenticatedChallenge(req)
+		if err != nil {
+			log.Printf("ERROR checking upload challenge: %s", err)
+			return httpInternalServerError
+		}
+		if !ok {
+			log.Printf("WARN unauthenticated upload failed challenge: %s", uur.client)
+			return httpForbidden
+		}
+	}
+	addr := requestAddress(req)
+	if !unauthenticatedLimiter.allow(addr, time.Now()) {
+		log.Printf("WARN unauthenticated upload limit reached: %s %s", addr, uur.client)
+		return httpTooManyRequests
+	}
+	uur.expires = UnauthenticatedUploadURLExpiry
+	uur.quarantine = true
+	if uur.post || uur.maxSize > 0 {
+		if uur.maxSize == 0 || uur.maxSize > MaxUnauthenticatedUploadSizeInBytes {
+			uur.maxSize = MaxUnauthenticatedUploadSizeInBytes
+		}
+		return nil
+	}
+	if uur.contentLength > MaxUnauthenticatedUploadSizeInBytes {
+		log.Printf("WARN unauthenticated upload too large: %d %s", uur.contentLength, uur.client)
+		return httpBadRequest
+	}
+	if uur.contentLength == 0 {
+		log.Printf("WARN unauthenticated PUT without content_length: %s", uur.client)
+	}
+	return nil
+}
+
+/* the quarantine tag once the scanner has passed an upload */
+const QuarantineCleared = "clean"
+
+var errQuarantined = errors.New("upload is quarantined")
+
+/* only unauthenticated uploads are quarantined, so only their keys
+   cost a HEAD before they are read. A PUT can't carry the pending
+   tag, so having no tag counts as not cleared either. */
+func checkQuarantine(ctx context.Context, tn *tenant, key string) error {
+	if !strings.HasPrefix(key, "unauthenticated/") {
+		return nil
+	}
+	info, err := awsHead(ctx, tn, key)
+	if err != nil {
+		return err
+	}
+	if info.metadata[strings.TrimPrefix(QuarantineMetadataField, "x-amz-meta-")] != QuarantineCleared {
+		return fmt.Errorf("%s: %w", key, errQuarantined)
+	}
+	return nil
+}
+
+/* what the quarantine scanner is sent for each unauthenticated
+   upload; Key is the full object key */
+type quarantineScanRequest struct {
+	Tenant string `json:"tenant"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+/* hands every unauthenticated upload that is recorded to the
+   scanner through QUARANTINE_SCAN_QUEUE_URL, as an upload hook. An
+   upload recorded twice is sent twice, the scanner has to cope. */
+func initQuarantineScanQueue() {
+	queueURL := os.Getenv("QUARANTINE_SCAN_QUEUE_URL")
+	if queueURL == "" {
+		log.Printf("INFO: no QUARANTINE_SCAN_QUEUE_URL, unauthenticated uploads stay quarantined until scanned otherwise")
+		return
+	}
+	scanQueue := &sqsUploadEventQueue{ svc: sqs.New(sess), url: queueURL }
+	registerUploadHook("quarantine-scan", func (ctx context.Context, upload *uploadRecord) error {
+		if !strings.HasPrefix(upload.key, "unauthenticated/") {
+			return nil
+		}
+		body, err := json.Marshal(&quarantineScanRequest{
+			Tenant: upload.tenant.Name,
+			Bucket: upload.tenant.Bucket,
+			Key: upload.tenant.key(upload.key),
+			ETag: upload.etag,
+			Size: upload.size,
+		})
+		if err != nil {
+			return err
+		}
+		return scanQueue.send(ctx, body)
+	})
+	log.Printf("INFO: sending unauthenticated uploads to %s for scanning", queueURL)
+}
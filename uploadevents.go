@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+/* Upload completion: S3 sends ObjectCreated notifications for every
+   tenant's bucket to an SQS queue. A worker takes them off the
+   queue, checks the object is really there, records it in the
+   upload index and runs the upload hooks for it. A message is only
+   deleted once all of that succeeded, so hooks must cope with
+   seeing an upload twice.
+
+   Without UPLOAD_EVENT_QUEUE_URL an in-memory queue stands in for
+   SQS, and POST /v1/upload_events puts a notification body on it so
+   the whole path can be driven locally. It needs the admin token,
+   and with SQS configured it is not there at all: only S3 writes to
+   the real queue. */
+
+const (
+	UploadEventWaitInSeconds = 20
+	UploadEventRetryInSeconds = 5
+	MaxUploadEventBodyInBytes = 256 << 10
+	MemoryUploadEventQueueLength = 1000
+	MemoryUploadEventVisibilityInSeconds = 30
+	MaxMemoryUploadEventReceives = 5
+)
+
+type uploadEventMessage struct {
+	body   []byte
+	handle string
+}
+
+type uploadEventQueue interface {
+	send(ctx context.Context, body []byte) error
+	/* waits up to UploadEventWaitInSeconds for messages */
+	receive(ctx context.Context) ([]uploadEventMessage, error)
+	delete(ctx context.Context, msg uploadEventMessage) error
+}
+
+type sqsUploadEventQueue struct {
+	svc *sqs.SQS
+	url string
+}
+
+func (q *sqsUploadEventQueue) send(ctx context.Context, body []byte) error {
+	_, err := q.svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl: aws.String(q.url),
+		MessageBody: aws.String(string(body)),
+	})
+	return err
+}
+
+func (q *sqsUploadEventQueue) receive(ctx context.Context) ([]uploadEventMessage, error) {
+	result, err := q.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl: aws.String(q.url),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds: aws.Int64(UploadEventWaitInSeconds),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var msgs []uploadEventMessage
+	for _, m := range result.Messages {
+		msgs = append(msgs, uploadEventMessage{
+			body: []byte(aws.StringValue(m.Body)),
+			handle: aws.StringValue(m.ReceiptHandle),
+		})
+	}
+	return msgs, nil
+}
+
+func (q *sqsUploadEventQueue) delete(ctx context.Context, msg uploadEventMessage) error {
+	_, err := q.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl: aws.String(q.url),
+		ReceiptHandle: aws.String(msg.handle),
+	})
+	return err
+}
+
+/* like SQS, a message that is not deleted within
+   MemoryUploadEventVisibilityInSeconds of being received is
+   delivered again, up to MaxMemoryUploadEventReceives times; unlike
+   SQS, everything is lost when the server stops */
+type memoryUploadEventQueue struct {
+	msgs     chan []byte
+	mu       sync.Mutex
+	next     int64
+	inFlight map[string]*memoryUploadEvent
+}
+
+type memoryUploadEvent struct {
+	body      []byte
+	receives  int
+	visibleAt time.Time
+}
+
+func newMemoryUploadEventQueue() *memoryUploadEventQueue {
+	return &memoryUploadEventQueue{
+		msgs: make(chan []byte, MemoryUploadEventQueueLength),
+		inFlight: map[string]*memoryUploadEvent{},
+	}
+}
+
+func (q *memoryUploadEventQueue) take(body []byte) uploadEventMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next++
+	handle := strconv.FormatInt(q.next, 10)
+	q.inFlight[handle] = &memoryUploadEvent{
+		body: body,
+		receives: 1,
+		visibleAt: time.Now().Add(MemoryUploadEventVisibilityInSeconds * time.Second),
+	}
+	return uploadEventMessage{ body: body, handle: handle }
+}
+
+/* the messages received before that were not deleted in time */
+func (q *memoryUploadEventQueue) redeliver(now time.Time) []uploadEventMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var msgs []uploadEventMessage
+	for handle, event := range q.inFlight {
+		if now.Before(event.visibleAt) {
+			continue
+		}
+		if event.receives >= MaxMemoryUploadEventReceives {
+			log.Printf("ERROR: dropping upload event after %d tries: %s", event.receives, oneLine(string(event.body)))
+			delete(q.inFlight, handle)
+			continue
+		}
+		event.receives++
+		event.visibleAt = now.Add(MemoryUploadEventVisibilityInSeconds * time.Second)
+		msgs = append(msgs, uploadEventMessage{ body: event.body, handle: handle })
+	}
+	return msgs
+}
+
+func (q *memoryUploadEventQueue) send(ctx context.Context, body []byte) error {
+	select {
+		case q.msgs <- body:
+			return nil
+		default:
+			return fmt.Errorf("upload event queue full")
+	}
+}
+
+func (q *memoryUploadEventQueue) receive(ctx context.Context) ([]uploadEventMessage, error) {
+	if msgs := q.redeliver(time.Now()); len(msgs) > 0 {
+		return msgs, nil
+	}
+	timer := time.NewTimer(UploadEventWaitInSeconds * time.Second)
+	defer timer.Stop()
+	select {
+		case body := <-q.msgs:
+			return []uploadEventMessage{ q.take(body) }, nil
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+	}
+}
+
+func (q *memoryUploadEventQueue) delete(ctx context.Context, msg uploadEventMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inFlight, msg.handle)
+	return nil
+}
+
+var uploadEvents uploadEventQueue
+
+/* whether every upload reaches the index, as far as the queue
+   goes; the in-memory queue only sees what is posted to this server
+   and loses it on restart */
+var uploadEventsDurable bool
+
+func initUploadEventQueue() {
+	if queueURL := os.Getenv("UPLOAD_EVENT_QUEUE_URL"); queueURL != "" {
+		uploadEvents = &sqsUploadEventQueue{ svc: sqs.New(sess), url: queueURL }
+		uploadEventsDurable = true
+		log.Printf("INFO: reading upload events from %s", queueURL)
+	} else {
+		uploadEvents = newMemoryUploadEventQueue()
+		log.Printf("INFO: no UPLOAD_EVENT_QUEUE_URL, using in-memory upload event queue")
+	}
+}
+
+/* the parts of an S3 event notification we use */
+type s3EventNotification struct {
+	Event   string          `json:"Event"`
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventName string    `json:"eventName"`
+	EventTime time.Time `json:"eventTime"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+/* notifications that went through SNS on the way */
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+func parseUploadEvent(body []byte) (*s3EventNotification, error) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Type == "Notification" {
+		body = []byte(envelope.Message)
+	}
+	var event s3EventNotification
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("bad upload event: %w", err)
+	}
+	return &event, nil
+}
+
+/* key is the tenant's, without its prefix */
+type uploadRecord struct {
+	tenant          *tenant
+	key             string
+	device          string
+	size            int64
+	etag            string
+	meetingInstance int64
+	startedAt       time.Time
+	uploadedAt      time.Time
+	source          string
+	metadata        map[string]string
+}
+
+/* hooks run for every recorded upload, in registration order */
+type uploadHook func(ctx context.Context, upload *uploadRecord) error
+
+type namedUploadHook struct {
+	name string
+	fn   uploadHook
+}
+
+var uploadHooks []namedUploadHook
+
+func registerUploadHook(name string, fn uploadHook) {
+	uploadHooks = append(uploadHooks, namedUploadHook{ name, fn })
+}
+
+/* keys this service writes itself rather than clients */
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, "exports/")
+}
+
+func ingestUploadRecord(ctx context.Context, record *s3EventRecord) error {
+	if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+		return nil
+	}
+	/* keys in notifications are form encoded */
+	objectKey, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil {
+		log.Printf("WARN: upload event with bad key %s", record.S3.Object.Key)
+		return nil
+	}
+	tn, key := tenantForObject(record.S3.Bucket.Name, objectKey)
+	if tn == nil {
+		log.Printf("WARN: upload event for unknown bucket %s", record.S3.Bucket.Name)
+		return nil
+	}
+	if isInternalKey(key) {
+		return nil
+	}
+	/* a notification could be stale or posted by hand, so only S3
+	   is trusted with the details */
+	info, err := awsHead(ctx, tn, key)
+	if err != nil {
+		if !isRetryable(err) {
+			log.Printf("WARN: upload event for missing object %s: %s", key, err)
+			return nil
+		}
+		return err
+	}
+	if err := attributeUpload(ctx, tn, key, info); err != nil {
+		return err
+	}
+	upload := newUploadRecord(tn, key, info, uploadEventSource(key, record.EventName))
+	if err := dbRecordUpload(ctx, upload); err != nil {
+		return err
+	}
+	for _, hook := range uploadHooks {
+		if err := hook.fn(ctx, upload); err != nil {
+			return fmt.Errorf("upload hook %s for %s: %w", hook.name, key, err)
+		}
+	}
+	log.Printf("INFO: recorded upload %s (%d bytes)", key, upload.size)
+	return nil
+}
+
+func ingestUploadEvent(ctx context.Context, body []byte) error {
+	event, err := parseUploadEvent(body)
+	if err != nil {
+		/* will never parse, no point redelivering it */
+		log.Printf("ERROR: %s", err)
+		return nil
+	}
+	if event.Event == "s3:TestEvent" {
+		return nil
+	}
+	for i := range event.Records {
+		if err := ingestUploadRecord(ctx, &event.Records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* runs until ctx is done; messages are handled in parallel, a
+   batch at a time */
+func runUploadEventWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		msgs, err := uploadEvents.receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR: could not receive upload events: %s", err)
+			select {
+				case <-ctx.Done():
+				case <-time.After(UploadEventRetryInSeconds * time.Second):
+			}
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, msg := range msgs {
+			wg.Add(1)
+			go func(msg uploadEventMessage) {
+				defer wg.Done()
+				if err := ingestUploadEvent(ctx, msg.body); err != nil {
+					/* left on the queue to be redelivered */
+					log.Printf("ERROR: could not ingest upload event: %s", err)
+					return
+				}
+				if err := uploadEvents.delete(ctx, msg); err != nil {
+					log.Printf("ERROR: could not delete upload event: %s", err)
+				}
+			}(msg)
+		}
+		wg.Wait()
+	}
+}
+
+func uploadEventsPost(req *http.Request) func(http.ResponseWriter) {
+	if uploadEventsDurable {
+		return httpNotFound
+	}
+	if !checkAdminToken(req) {
+		log.Printf("WARN: upload event without a valid admin token from %s", req.RemoteAddr)
+		return httpForbidden
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxUploadEventBodyInBytes + 1))
+	if err != nil {
+		log.Printf("ERROR: could not read upload event: %s", err)
+		return httpBadRequest
+	}
+	if len(body) > MaxUploadEventBodyInBytes {
+		log.Printf("WARN: upload event too large")
+		return httpBadRequest
+	}
+	if _, err := parseUploadEvent(body); err != nil {
+		log.Printf("WARN: %s", err)
+		return httpBadRequest
+	}
+	if err := uploadEvents.send(req.Context(), body); err != nil {
+		log.Printf("ERROR: could not queue upload event: %s", err)
+		return httpInternalServerError
+	}
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* The upload index is the uploads table: one row per object,
+   written when S3 tells us about an upload (see uploadevents.go),
+   when a multipart upload is completed through us, and by the
+   backfill-index command for everything uploaded before that.
+
+   The index only replaces listing where it is known to be complete:
+   a full backfill of the tenant has finished (its start time is the
+   tenant's watermark in upload_index_watermarks), events come from
+   SQS rather than the in-memory queue, and the range ended long
+   enough ago for its events to have arrived. Run the backfill after
+   the event queue is in place, uploads before the backfill started
+   are its job and the ones after are the events'. Anything else is
+   listed. */
+
+var useUploadIndex = true
+
+const (
+	BackfillProgressEvery = 10000
+	UploadIndexLagInMinutes = 30
+)
+
+func newUploadRecord(tn *tenant, key string, info *awsObjectInfo, source string) *uploadRecord {
+	upload := &uploadRecord{
+		tenant: tn,
+		key: key,
+		size: info.size,
+		etag: info.etag,
+		uploadedAt: info.lastModified,
+		source: source,
+		metadata: info.metadata,
+	}
+	if pk := parseKey(key); pk != nil {
+		upload.device = pk.device
+		upload.startedAt = pk.timestamp
+		upload.meetingInstance, _ = strconv.ParseInt(pk.instance, 10, 64)
+	}
+	/* the key wins where both say; listings carry no metadata */
+	if upload.device == "" {
+		upload.device = info.metadata[DeviceMetadataKey]
+	}
+	if upload.meetingInstance == 0 {
+		upload.meetingInstance, _ = strconv.ParseInt(info.metadata[MeetingInstanceMetadataKey], 10, 64)
+	}
+	return upload
+}
+
+/* which of our endpoints the object came in through, as far as the
+   event tells */
+func uploadEventSource(key string, eventName string) string {
+	if strings.HasPrefix(key, "/inbound/") {
+		return "logs_post"
+	}
+	switch strings.TrimPrefix(eventName, "ObjectCreated:") {
+		case "Put":
+			return "upload_url"
+		case "Post":
+			return "upload_post"
+		case "CompleteMultipartUpload":
+			return "multipart"
+		default:
+			return "event"
+	}
+}
+
+/* presigned PUTs carry no metadata, what the request said is in
+   upload_attributions instead; the object's own metadata wins */
+func attributeUpload(ctx context.Context, tn *tenant, key string, info *awsObjectInfo) error {
+	if info.metadata[DeviceMetadataKey] != "" && info.metadata[MeetingInstanceMetadataKey] != "" {
+		return nil
+	}
+	attribution, err := dbUploadAttribution(ctx, tn, key)
+	if err != nil {
+		return err
+	}
+	if info.metadata == nil {
+		info.metadata = map[string]string{}
+	}
+	for name, value := range attribution {
+		if info.metadata[name] == "" {
+			info.metadata[name] = value
+		}
+	}
+	return nil
+}
+
+/* for uploads we see complete ourselves; the S3 event that follows
+   finds the row already there */
+func indexUpload(ctx context.Context, tn *tenant, key string, source string) error {
+	info, err := awsHead(ctx, tn, key)
+	if err != nil {
+		return err
+	}
+	if err := attributeUpload(ctx, tn, key, info); err != nil {
+		return err
+	}
+	return dbRecordUpload(ctx, newUploadRecord(tn, key, info, source))
+}
+
+/* whether the index has every upload of tn up to to */
+func uploadIndexCovers(ctx context.Context, tn *tenant, to time.Time) bool {
+	if !useUploadIndex || !uploadEventsDurable {
+		return false
+	}
+	if time.Since(to) < UploadIndexLagInMinutes * time.Minute {
+		return false
+	}
+	watermark, err := dbUploadIndexWatermark(ctx, tn)
+	if err != nil {
+		log.Printf("WARN: upload index watermark unavailable, listing instead: %s", err)
+		return false
+	}
+	return watermark != nil
+}
+
+/* the keys listLogDays would list for the same range; ok is false
+   if the index cannot be trusted with it, in which case the caller
+   lists */
+func indexedLogKeys(ctx context.Context, tn *tenant, scanDir string, from time.Time, to time.Time) (keys []string, ok bool) {
+	if !uploadIndexCovers(ctx, tn, to) {
+		return nil, false
+	}
+	after := tn.key(keyLayoutsStartAfter(scanDir, from))
+	before := tn.key(scanDir + to.AddDate(0, 0, 2).Format(dayDirLayout))
+	keys, err := dbIndexedKeys(ctx, tn.Bucket, after, before)
+	if err != nil {
+		log.Printf("WARN: upload index unavailable, listing instead: %s", err)
+		return nil, false
+	}
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], tn.Prefix)
+	}
+	return keys, true
+}
+
+/* uploads tagged with the meeting instance, by the tenant's keys */
+func meetingInstanceUploads(ctx context.Context, tn *tenant, id int64) ([]indexedUpload, error) {
+	uploads, err := dbMeetingInstanceUploads(ctx, tn.Bucket, id)
+	if err != nil {
+		return nil, err
+	}
+	var own []indexedUpload
+	for _, upload := range uploads {
+		/* another tenant sharing the bucket */
+		if owner, key := tenantForObject(tn.Bucket, upload.key); owner == tn {
+			upload.key = key
+			own = append(own, upload)
+		}
+	}
+	return own, nil
+}
+
+/* logprocessor backfill-index [-tenant name] [-prefix p] [-start-after key -started time]
+
+   Indexes every object under prefix that a listing returns. Rows
+   that are already there keep their source. Restart an interrupted
+   run with -start-after set to the last key it reported and
+   -started set to when the first run started, as it logged.
+
+   A run over the whole tenant (no -prefix) that gets to the end
+   sets the tenant's watermark to when it started. */
+func runBackfillIndex(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill-index", flag.ExitOnError)
+	name := flags.String("tenant", "default", "tenant to index")
+	prefix := flags.String("prefix", "", "only index keys under this prefix")
+	startAfter := flags.String("start-after", "", "resume after this key")
+	started := flags.String("started", "", "when the run being resumed started (RFC 3339)")
+	flags.Parse(args)
+	tn := tenantByName(*name)
+	if tn == nil {
+		return fmt.Errorf("no tenant %s", *name)
+	}
+	startedAt := time.Now().UTC()
+	if *started != "" {
+		t, err := time.Parse(time.RFC3339, *started)
+		if err != nil {
+			return fmt.Errorf("bad -started: %w", err)
+		}
+		startedAt = t.UTC()
+	} else if *startAfter != "" {
+		log.Printf("WARN: resuming without -started, the watermark will not be set")
+	}
+	log.Printf("INFO: backfill of %s started %s", tn.Name, startedAt.Format(time.RFC3339))
+
+	indexed := 0
+	var failed error
+	err := awsListObjects(ctx, tn, *prefix, *startAfter, func (key string, info *awsObjectInfo) bool {
+		if isInternalKey(key) {
+			return true
+		}
+		err := attributeUpload(ctx, tn, key, info)
+		if err == nil {
+			err = dbRecordUpload(ctx, newUploadRecord(tn, key, info, "backfill"))
+		}
+		if err != nil {
+			log.Printf("ERROR: could not index %s: %s", key, err)
+			failed = err
+			return false
+		}
+		indexed++
+		if indexed % BackfillProgressEvery == 0 {
+			log.Printf("INFO: indexed %d objects, last %s", indexed, key)
+		}
+		return true
+	})
+	if err == nil {
+		err = failed
+	}
+	log.Printf("INFO: backfill indexed %d objects", indexed)
+	if err != nil || *prefix != "" || (*startAfter != "" && *started == "") {
+		return err
+	}
+	if err := dbSetUploadIndexWatermark(ctx, tn, startedAt); err != nil {
+		return err
+	}
+	log.Printf("INFO: upload index of %s complete up to %s", tn.Name, startedAt.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/* Everything that ends up in an upload key comes from the query
+   string, so each component is checked before it is interpolated:
+   a single path segment from a small charset, bounded in length,
+   and a date that exists and is not in the future. */
+
+const (
+	MaxKeySegmentLength = 128
+	MaxUploadFileNameLength = 255
+	EarliestUploadYear = 2010
+)
+
+var keySegmentRE = regexp.MustCompile(`^[A-Za-z0-9_~-][A-Za-z0-9._~-]*$`)
+
+func checkKeySegment(name string, value string, maxLength int) error {
+	if value == "" {
+		return fmt.Errorf("missing %s", name)
+	}
+	if len(value) > maxLength {
+		return fmt.Errorf("%s longer than %d", name, maxLength)
+	}
+	/* the leading character excludes "." and ".." as well */
+	if !keySegmentRE.MatchString(value) {
+		return fmt.Errorf("bad %s %q", name, value)
+	}
+	return nil
+}
+
+/* fills in today's UTC date if none was given and normalizes
+   the date to the zero-padded form used in keys */
+func checkUploadDate(uur *uploadURLRequest, now time.Time) error {
+	if uur.year == "" && uur.month == "" && uur.day == "" {
+		now = now.UTC()
+		uur.year = fmt.Sprintf("%04d", now.Year())
+		uur.month = fmt.Sprintf("%02d", int(now.Month()))
+		uur.day = fmt.Sprintf("%02d", now.Day())
+		return nil
+	}
+	if len(uur.year) != 4 || len(uur.month) < 1 || len(uur.month) > 2 || len(uur.day) < 1 || len(uur.day) > 2 {
+		return fmt.Errorf("bad date %q/%q/%q", uur.year, uur.month, uur.day)
+	}
+	year, yerr := strconv.Atoi(uur.year)
+	month, merr := strconv.Atoi(uur.month)
+	day, derr := strconv.Atoi(uur.day)
+	if yerr != nil || merr != nil || derr != nil {
+		return fmt.Errorf("bad date %q/%q/%q", uur.year, uur.month, uur.day)
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if t.Year() != year || int(t.Month()) != month || t.Day() != day {
+		return fmt.Errorf("no such date %q/%q/%q", uur.year, uur.month, uur.day)
+	}
+	/* clients west of UTC are a day behind us, east of it a day ahead */
+	if year < EarliestUploadYear || t.After(now.UTC().AddDate(0, 0, 1)) {
+		return fmt.Errorf("date %s out of range", t.Format("2006-01-02"))
+	}
+	uur.year = fmt.Sprintf("%04d", year)
+	uur.month = fmt.Sprintf("%02d", month)
+	uur.day = fmt.Sprintf("%02d", day)
+	return nil
+}
+
+/* checks the components the layout puts into the key; must run
+   after all special handling of parameters */
+func checkUploadKey(uur *uploadURLRequest, layout uploadLayout, now time.Time) error {
+	var err error
+	switch layout.name {
+		case normalLayout.name:
+			err = checkKeySegment("device_id", uur.deviceId, MaxKeySegmentLength)
+		case downloadLayout.name:
+			err = checkKeySegment("download_token", uur.downloadToken, MaxKeySegmentLength)
+		case unauthenticatedLayout.name:
+			err = checkKeySegment("client", uur.client, MaxKeySegmentLength)
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkKeySegment("file_name", uur.fileName, MaxUploadFileNameLength); err != nil {
+		return err
+	}
+	return checkUploadDate(uur, now)
+}